@@ -0,0 +1,103 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// batteryKey matches the temperature and cycle keys of the battery packs. The
+// master BMS is bms_bmsStatus (DELTA 2, RIVER 2) or bmsMaster (DELTA Pro,
+// DELTA Max), extra batteries are bmsSlave<n> or bms_slave_bmsSlaveStatus_<n>.
+var batteryKey = regexp.MustCompile(`^(?:bms_bmsStatus|bmsMaster|bmsSlave(\d+)|bms_slave_bmsSlaveStatus_(\d+))\.(temp|cycles)$`)
+
+// batteryValue is the temperature or cycle count of one pack, the master BMS is
+// bms 0
+type batteryValue struct {
+	bms   string
+	value float64
+}
+
+// batteryValues returns the temp and cycles values of all packs by bms index
+func batteryValues(data quota) (temps, cycles []batteryValue) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		match := batteryKey.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+		bms := "0"
+		if match[1] != "" {
+			bms = match[1]
+		} else if match[2] != "" {
+			bms = match[2]
+		}
+		// a device reporting both master prefixes only counts once
+		if seen[bms+match[3]] {
+			continue
+		}
+		value, ok := data.number(key)
+		if !ok {
+			continue
+		}
+		seen[bms+match[3]] = true
+		if match[3] == "temp" {
+			temps = append(temps, batteryValue{bms, value})
+		} else {
+			cycles = append(cycles, batteryValue{bms, value})
+		}
+	}
+	return temps, cycles
+}
+
+// collectBatteries sends the temperature and cycles of every pack the device
+// reported
+func collectBatteries(ch chan<- prometheus.Metric, temp, cycles *prometheus.Desc, data quota) {
+	temps, counts := batteryValues(data)
+	for _, battery := range temps {
+		ch <- prometheus.MustNewConstMetric(temp, prometheus.GaugeValue, battery.value, battery.bms)
+	}
+	for _, battery := range counts {
+		ch <- prometheus.MustNewConstMetric(cycles, prometheus.GaugeValue, battery.value, battery.bms)
+	}
+}
+
+// the charge and discharge remain times in minutes, DELTA 2/RIVER 2 and DELTA
+// Pro keys
+var (
+	chargeRemainKeys    = []string{"bms_emsStatus.chgRemainTime", "ems.chgRemainTime"}
+	dischargeRemainKeys = []string{"bms_emsStatus.dsgRemainTime", "ems.dsgRemainTime"}
+)
+
+// remainSeconds returns the first of the remain time keys in seconds
+func remainSeconds(data quota, keys []string) (float64, bool) {
+	for _, key := range keys {
+		if minutes, ok := data.number(key); ok {
+			return minutes * 60, true
+		}
+	}
+	return 0, false
+}
+
+// collectRemainTimes sends time to full while the battery is charging and time
+// to empty while it is discharging. The device keeps reporting both, the
+// inactive one as a placeholder.
+func collectRemainTimes(ch chan<- prometheus.Metric, toFull, toEmpty *prometheus.Desc, data quota, summary EcoflowApiData) {
+	switch {
+	case summary.WattsInSum > summary.WattsOutSum:
+		if seconds, ok := remainSeconds(data, chargeRemainKeys); ok {
+			ch <- prometheus.MustNewConstMetric(toFull, prometheus.GaugeValue, seconds)
+		}
+	case summary.WattsOutSum > summary.WattsInSum:
+		if seconds, ok := remainSeconds(data, dischargeRemainKeys); ok {
+			ch <- prometheus.MustNewConstMetric(toEmpty, prometheus.GaugeValue, seconds)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBatteries(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	header := `
+# HELP ecoflow_battery_cycles Battery charge cycles by BMS, 0 is the master
+# TYPE ecoflow_battery_cycles gauge
+`
+	for _, test := range []struct {
+		sn, data, expected string
+	}{
+		{
+			// DELTA Pro with two extra batteries
+			sn: "X42",
+			data: `"model":"DELTA Pro","bmsMaster.temp":27,"bmsMaster.cycles":112,"bmsMaster.soc":80,` +
+				`"bmsSlave1.temp":25,"bmsSlave1.cycles":40,"bmsSlave2.temp":31,"bmsSlave2.cycles":3`,
+			expected: header + `ecoflow_battery_cycles{bms="0",description="X42",sn="X42"} 112
+ecoflow_battery_cycles{bms="1",description="X42",sn="X42"} 40
+ecoflow_battery_cycles{bms="2",description="X42",sn="X42"} 3
+# HELP ecoflow_battery_temp_celsius Battery temperature by BMS, 0 is the master
+# TYPE ecoflow_battery_temp_celsius gauge
+ecoflow_battery_temp_celsius{bms="0",description="X42",sn="X42"} 27
+ecoflow_battery_temp_celsius{bms="1",description="X42",sn="X42"} 25
+ecoflow_battery_temp_celsius{bms="2",description="X42",sn="X42"} 31
+`,
+		},
+		{
+			// DELTA 2 with only the master BMS
+			sn:   "X43",
+			data: `"model":"DELTA 2","bms_bmsStatus.temp":22,"bms_bmsStatus.cycles":9`,
+			expected: header + `ecoflow_battery_cycles{bms="0",description="X43",sn="X43"} 9
+# HELP ecoflow_battery_temp_celsius Battery temperature by BMS, 0 is the master
+# TYPE ecoflow_battery_temp_celsius gauge
+ecoflow_battery_temp_celsius{bms="0",description="X43",sn="X43"} 22
+`,
+		},
+	} {
+		api.setQuota(test.sn, `{"code":"0","message":"Success","data":{`+test.data+`}}`)
+		exporter, err := CreateExporters(api.device(test.sn), api.options())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(test.expected), "ecoflow_battery_temp_celsius", "ecoflow_battery_cycles"); err != nil {
+			t.Errorf("%s: %s", test.sn, err)
+		}
+	}
+}
+
+func TestRemainTimes(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	for _, test := range []struct {
+		sn, data, expected string
+	}{
+		{
+			// DELTA 2 charging, the discharge time is a placeholder
+			sn:   "X47",
+			data: `"wattsInSum":500,"wattsOutSum":20,"bms_emsStatus.chgRemainTime":45,"bms_emsStatus.dsgRemainTime":5999`,
+			expected: `
+# HELP ecoflow_time_to_full_seconds Remaining time until the battery is full, only while charging
+# TYPE ecoflow_time_to_full_seconds gauge
+ecoflow_time_to_full_seconds{description="X47",sn="X47"} 2700
+`,
+		},
+		{
+			// DELTA Pro discharging
+			sn:   "X48",
+			data: `"wattsInSum":0,"wattsOutSum":300,"ems.chgRemainTime":5999,"ems.dsgRemainTime":120`,
+			expected: `
+# HELP ecoflow_time_to_empty_seconds Remaining time until the battery is empty, only while discharging
+# TYPE ecoflow_time_to_empty_seconds gauge
+ecoflow_time_to_empty_seconds{description="X48",sn="X48"} 7200
+`,
+		},
+		{
+			// idle, neither is meaningful
+			sn:   "X49",
+			data: `"wattsInSum":0,"wattsOutSum":0,"bms_emsStatus.chgRemainTime":5999,"bms_emsStatus.dsgRemainTime":5999`,
+		},
+	} {
+		api.setQuota(test.sn, `{"code":"0","message":"Success","data":{`+test.data+`}}`)
+		exporter, err := CreateExporters(api.device(test.sn), api.options())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(test.expected), "ecoflow_time_to_full_seconds", "ecoflow_time_to_empty_seconds"); err != nil {
+			t.Errorf("%s: %s", test.sn, err)
+		}
+	}
+}
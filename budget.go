@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// retryBudget is a token bucket of retries shared by all devices, so an outage
+// of the API doesn't multiply the requests by the retries of every device. It
+// holds at most a minute of retries and refills continuously.
+type retryBudget struct {
+	mutex     sync.Mutex
+	perMinute float64
+	tokens    float64
+	last      time.Time
+	now       func() time.Time
+}
+
+// newRetryBudget returns a full budget of perMinute retries, nil for no limit
+func newRetryBudget(perMinute int, now func() time.Time) *retryBudget {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &retryBudget{perMinute: float64(perMinute), tokens: float64(perMinute), last: now(), now: now}
+}
+
+// refill adds the tokens of the time since the last refill, the caller holds
+// the mutex
+func (budget *retryBudget) refill() {
+	now := budget.now()
+	budget.tokens += now.Sub(budget.last).Minutes() * budget.perMinute
+	if budget.tokens > budget.perMinute {
+		budget.tokens = budget.perMinute
+	}
+	budget.last = now
+}
+
+// take uses up a retry, false if none is left. A nil budget always allows it.
+func (budget *retryBudget) take() bool {
+	if budget == nil {
+		return true
+	}
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	budget.refill()
+	if budget.tokens < 1 {
+		return false
+	}
+	budget.tokens--
+	return true
+}
+
+// available returns the retries left, for ecoflow_retry_budget_tokens
+func (budget *retryBudget) available() float64 {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	budget.refill()
+	return budget.tokens
+}
+
+// used returns the fraction of the budget taken, for
+// ecoflow_rate_limit_budget_used
+func (budget *retryBudget) used() float64 {
+	return 1 - budget.available()/budget.perMinute
+}
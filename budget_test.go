@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetryBudget(t *testing.T) {
+	clock := newFakeClock()
+	budget := newRetryBudget(2, clock.Now)
+	for i, want := range []bool{true, true, false} {
+		if got := budget.take(); got != want {
+			t.Errorf("take %d: got %v, want %v", i+1, got, want)
+		}
+	}
+
+	// a retry comes back every 30s, the budget never holds more than a minute
+	if used := budget.used(); used != 1 {
+		t.Errorf("got %v of the budget used, want 1", used)
+	}
+	clock.advance(30 * time.Second)
+	if tokens := budget.available(); tokens != 1 {
+		t.Errorf("got %v tokens after 30s, want 1", tokens)
+	}
+	if used := budget.used(); used != 0.5 {
+		t.Errorf("got %v of the budget used after 30s, want 0.5", used)
+	}
+	clock.advance(time.Hour)
+	if tokens := budget.available(); tokens != 2 {
+		t.Errorf("got %v tokens after an hour, want 2", tokens)
+	}
+
+	var unlimited *retryBudget
+	if newRetryBudget(0, clock.Now) != nil || !unlimited.take() {
+		t.Error("budget 0 limits the retries")
+	}
+}
+
+func TestRetryBudgetShared(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.fail("X69", 10, http.StatusBadGateway, nil)
+	api.fail("X70", 10, http.StatusBadGateway, nil)
+
+	options := api.options()
+	options.MaxRetries = 2
+	options.RetryBackoff = time.Millisecond
+	options.RetryBudget = newRetryBudget(1, newFakeClock().Now)
+	skipped := testutil.ToFloat64(retriesSkipped)
+
+	for _, sn := range []string{"X69", "X70"} {
+		device := api.device(sn)
+		if _, err := getEcoflowApiData(context.Background(), &device, options); err == nil {
+			t.Errorf("%s: got no error", sn)
+		}
+	}
+	// the first device uses up the only retry
+	if requests := api.requestCount("X69"); requests != 2 {
+		t.Errorf("got %d requests of X69, want 2", requests)
+	}
+	if requests := api.requestCount("X70"); requests != 1 {
+		t.Errorf("got %d requests of X70, want 1", requests)
+	}
+	if got := testutil.ToFloat64(retriesSkipped) - skipped; got != 2 {
+		t.Errorf("got %v skipped retries, want 2", got)
+	}
+}
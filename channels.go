@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// powerChannel is a power input or output of a device, the sum of the quota
+// keys of its ports. The channels of a device are the ones of its layout it
+// reports any key of.
+type powerChannel struct {
+	name string
+	keys []string
+}
+
+// watts returns the power of the channel, false when the device reported none
+// of its keys
+func (channel powerChannel) watts(data quota) (float64, bool) {
+	var sum float64
+	found := false
+	for _, key := range channel.keys {
+		if value, ok := data.number(key); ok {
+			sum += value
+			found = true
+		}
+	}
+	return sum, found
+}
+
+// collectChannels sends a metric for every channel the device reported
+func collectChannels(ch chan<- prometheus.Metric, desc *prometheus.Desc, channels []powerChannel, data quota) {
+	for _, channel := range channels {
+		watts, ok := channel.watts(data)
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, watts, channel.name)
+	}
+}
+
+// meter is a voltage or current quota key of a channel, scale converts the
+// unit of the key (mV, 0.1 V, mA, ...) to volts or amps
+type meter struct {
+	channel string
+	key     string
+	scale   float64
+}
+
+// electricalMeters are the power, voltage, current and switch keys of a model,
+// the layouts are in models.yaml
+type electricalMeters struct {
+	wattsIn  []powerChannel
+	wattsOut []powerChannel
+
+	inputVolts  []meter
+	outputVolts []meter
+	inputAmps   []meter
+	outputAmps  []meter
+
+	// solar are the PV inputs, with the PV string as channel
+	solarWatts []meter
+	solarVolts []meter
+	solarAmps  []meter
+	// generated is the key of the solar energy total in Wh
+	generated string
+
+	// acTargetVolts and acTargetFrequency are the configured inverter output,
+	// nil for models with a fixed output
+	acTargetVolts     *meter
+	acTargetFrequency *meter
+
+	// outputSwitches are the on/off states of the output ports
+	outputSwitches []outputSwitch
+}
+
+// collectMeters sends a metric for every meter the device reported
+func collectMeters(ch chan<- prometheus.Metric, desc *prometheus.Desc, meters []meter, data quota) {
+	for _, meter := range meters {
+		value, ok := data.number(meter.key)
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value*meter.scale, meter.channel)
+	}
+}
+
+// collectTarget sends the configured value if the model has one and the device
+// reported it
+func collectTarget(ch chan<- prometheus.Metric, desc *prometheus.Desc, target *meter, data quota) {
+	if target == nil {
+		return
+	}
+	if value, ok := data.number(target.key); ok {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value*target.scale)
+	}
+}
+
+// batteryChargeKeys are the power flowing into the battery, DELTA 2/RIVER 2 and
+// DELTA Pro keys
+var batteryChargeKeys = []string{"bms_bmsStatus.inputWatts", "bmsMaster.inputWatts"}
+
+// solarChargeEfficiency returns the battery charge power per solar input power,
+// NaN without solar input. false if the device reports either of them not at all.
+func solarChargeEfficiency(data quota, meters electricalMeters) (float64, bool) {
+	var solar float64
+	found := false
+	for _, meter := range meters.solarWatts {
+		if value, ok := data.number(meter.key); ok {
+			solar += value * meter.scale
+			found = true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	charge, ok := powerChannel{keys: batteryChargeKeys}.watts(data)
+	if !ok {
+		return 0, false
+	}
+	if solar <= 0 {
+		return math.NaN(), true
+	}
+	return charge / solar, true
+}
+
+// generationCounter turns an energy total of the device into a counter
+// that doesn't go back when the device resets its total
+type generationCounter struct {
+	offset float64
+	last   float64
+	known  bool
+}
+
+func (counter *generationCounter) update(total float64) {
+	if counter.known && total < counter.last {
+		counter.offset += counter.last
+	}
+	counter.last = total
+	counter.known = true
+}
+
+func (counter *generationCounter) value() float64 {
+	return counter.offset + counter.last
+}
+
+// outputSwitch is the on/off state of an output port, the first of its keys
+// the device reports wins. present marks keys whose value isn't a switch, the
+// port counts as enabled whenever they're reported.
+type outputSwitch struct {
+	port    string
+	keys    []string
+	present bool
+}
+
+// switchState normalizes the switch values of the API, numbers, booleans and
+// their string forms, to 1 or 0
+func switchState(raw json.RawMessage) (float64, bool) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return 0, false
+	}
+	if text, ok := value.(string); ok {
+		switch strings.ToLower(strings.TrimSpace(text)) {
+		case "1", "true", "on":
+			return 1, true
+		case "0", "false", "off":
+			return 0, true
+		}
+		number, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return 0, false
+		}
+		value = number
+	}
+	state, ok := quotaValue(value)
+	if !ok {
+		return 0, false
+	}
+	if state != 0 {
+		return 1, true
+	}
+	return 0, true
+}
+
+// collectSwitches sends the state of every port the device reported a switch
+// of
+func collectSwitches(ch chan<- prometheus.Metric, desc *prometheus.Desc, switches []outputSwitch, data quota) {
+	for _, output := range switches {
+		for _, key := range output.keys {
+			raw, ok := data[key]
+			if !ok {
+				continue
+			}
+			state := 1.0
+			if !output.present {
+				if state, ok = switchState(raw); !ok {
+					continue
+				}
+			}
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, state, output.port)
+			break
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSwitchState(t *testing.T) {
+	for _, test := range []struct {
+		raw   string
+		state float64
+		ok    bool
+	}{
+		{`1`, 1, true},
+		{`0`, 0, true},
+		{`2`, 1, true},
+		{`true`, 1, true},
+		{`false`, 0, true},
+		{`"1"`, 1, true},
+		{`"0"`, 0, true},
+		{`"true"`, 1, true},
+		{`"False"`, 0, true},
+		{`"on"`, 1, true},
+		{`"off"`, 0, true},
+		{`"enabled"`, 0, false},
+		{`null`, 0, false},
+		{`{}`, 0, false},
+	} {
+		state, ok := switchState(json.RawMessage(test.raw))
+		if state != test.state || ok != test.ok {
+			t.Errorf("switchState(%s) = %v, %v, want %v, %v", test.raw, state, ok, test.state, test.ok)
+		}
+	}
+}
+
+func TestOutputEnabled(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X1", `{"code":"0","message":"Success","data":{"inv.cfgAcEnabled":true,"mppt.cfgAcEnabled":0,"pd.dcOutState":"0","pd.usbUsedTime":1200}}`)
+	api.setQuota("X2", `{"code":"0","message":"Success","data":{"mppt.cfgAcEnabled":1}}`)
+
+	expected := map[string]string{
+		"X1": `
+# HELP ecoflow_output_enabled Whether the output port is switched on: ac, dc or usb
+# TYPE ecoflow_output_enabled gauge
+ecoflow_output_enabled{description="X1",port="ac",sn="X1"} 1
+ecoflow_output_enabled{description="X1",port="dc",sn="X1"} 0
+ecoflow_output_enabled{description="X1",port="usb",sn="X1"} 1
+`,
+		// ports without a switch key are omitted
+		"X2": `
+# HELP ecoflow_output_enabled Whether the output port is switched on: ac, dc or usb
+# TYPE ecoflow_output_enabled gauge
+ecoflow_output_enabled{description="X2",port="ac",sn="X2"} 1
+`,
+	}
+	for sn, want := range expected {
+		exporter, err := CreateExporters(api.device(sn), api.options())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "ecoflow_output_enabled"); err != nil {
+			t.Errorf("%s: %s", sn, err)
+		}
+	}
+}
+
+func TestPowerChannelsByModel(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	for _, test := range []struct {
+		sn, data, expected string
+	}{
+		{
+			// DELTA 2 reports all ports, the usb ports add up
+			sn:   "X33",
+			data: `"model":"DELTA 2","inv.inputWatts":120,"mppt.inWatts":300,"inv.outputWatts":80,"pd.carWatts":12,"pd.usb1Watts":5,"pd.typec1Watts":20`,
+			expected: `
+# HELP ecoflow_watts_in Current watts input by channel: ac or solar
+# TYPE ecoflow_watts_in gauge
+ecoflow_watts_in{channel="ac",description="X33",sn="X33"} 120
+ecoflow_watts_in{channel="solar",description="X33",sn="X33"} 300
+# HELP ecoflow_watts_out Current watts output by channel: ac, dc or usb
+# TYPE ecoflow_watts_out gauge
+ecoflow_watts_out{channel="ac",description="X33",sn="X33"} 80
+ecoflow_watts_out{channel="dc",description="X33",sn="X33"} 12
+ecoflow_watts_out{channel="usb",description="X33",sn="X33"} 25
+`,
+		},
+		{
+			// RIVER 2 without solar input and car port
+			sn:   "X34",
+			data: `"model":"RIVER 2","inv.inputWatts":0,"inv.outputWatts":45,"pd.usb1Watts":3,"pd.usb2Watts":4`,
+			expected: `
+# HELP ecoflow_watts_in Current watts input by channel: ac or solar
+# TYPE ecoflow_watts_in gauge
+ecoflow_watts_in{channel="ac",description="X34",sn="X34"} 0
+# HELP ecoflow_watts_out Current watts output by channel: ac, dc or usb
+# TYPE ecoflow_watts_out gauge
+ecoflow_watts_out{channel="ac",description="X34",sn="X34"} 45
+ecoflow_watts_out{channel="usb",description="X34",sn="X34"} 7
+`,
+		},
+		{
+			// the micro inverter has none of the channels
+			sn:   "X35",
+			data: `"model":"PowerStream","20_1.pv1InputWatts":1543,"20_1.invOutputWatts":2400`,
+		},
+	} {
+		api.setQuota(test.sn, `{"code":"0","message":"Success","data":{`+test.data+`}}`)
+		exporter, err := CreateExporters(api.device(test.sn), api.options())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(test.expected), "ecoflow_watts_in", "ecoflow_watts_out"); err != nil {
+			t.Errorf("%s: %s", test.sn, err)
+		}
+	}
+}
+
+func TestMetersOf(t *testing.T) {
+	for _, test := range []struct {
+		model      string
+		acInVolts  string
+		solarWatts []string
+	}{
+		{"DELTA 2", "inv.acInVol", []string{"mppt.inWatts"}},
+		{"River 2 Pro", "inv.acInVol", []string{"mppt.inWatts"}},
+		{"DELTA Pro", "inv.acInVol", []string{"mppt.inWatts"}},
+		{"PowerStream", "", []string{"20_1.pv1InputWatts", "20_1.pv2InputWatts"}},
+		// unknown models use the DELTA 2 layout
+		{"", "inv.acInVol", []string{"mppt.inWatts"}},
+		{"GLACIER", "inv.acInVol", []string{"mppt.inWatts"}},
+	} {
+		meters := defaultModels.metersOf(test.model)
+		var acInVolts string
+		for _, meter := range meters.inputVolts {
+			if meter.channel == "ac" {
+				acInVolts = meter.key
+			}
+		}
+		var solarWatts []string
+		for _, meter := range meters.solarWatts {
+			solarWatts = append(solarWatts, meter.key)
+		}
+		if acInVolts != test.acInVolts || strings.Join(solarWatts, " ") != strings.Join(test.solarWatts, " ") {
+			t.Errorf("metersOf(%q): got ac input %q and solar %v, want %q and %v", test.model, acInVolts, solarWatts, test.acInVolts, test.solarWatts)
+		}
+	}
+
+	// the DELTA Pro reports mV where the DELTA 2 reports 0.1 V
+	if delta2, pro := defaultModels.metersOf("DELTA 2").solarVolts[0].scale, defaultModels.metersOf("DELTA PRO").solarVolts[0].scale; delta2 != 0.1 || pro != 0.001 {
+		t.Errorf("got solar volts scale %v for DELTA 2 and %v for DELTA Pro, want 0.1 and 0.001", delta2, pro)
+	}
+}
+
+func TestElectricalMeters(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	help := map[string]string{
+		"ecoflow_input_volts":  "# HELP ecoflow_input_volts Input voltage by channel: ac or solar\n# TYPE ecoflow_input_volts gauge",
+		"ecoflow_input_amps":   "# HELP ecoflow_input_amps Input current by channel: ac or solar\n# TYPE ecoflow_input_amps gauge",
+		"ecoflow_output_volts": "# HELP ecoflow_output_volts Output voltage by channel: ac or dc\n# TYPE ecoflow_output_volts gauge",
+		"ecoflow_output_amps":  "# HELP ecoflow_output_amps Output current by channel: ac or dc\n# TYPE ecoflow_output_amps gauge",
+	}
+	for _, test := range []struct {
+		sn, data string
+		expected []string
+	}{
+		{
+			// DELTA 2 reports the solar input in 0.1 V and 0.01 A
+			sn:   "X52",
+			data: `"model":"DELTA 2","inv.acInVol":230000,"inv.acInAmp":1500,"mppt.inVol":480,"mppt.inAmp":350,"mppt.carOutVol":125,"mppt.carOutAmp":400`,
+			expected: []string{
+				help["ecoflow_input_amps"],
+				`ecoflow_input_amps{channel="ac",description="X52",sn="X52"} 1.5`,
+				`ecoflow_input_amps{channel="solar",description="X52",sn="X52"} 3.5`,
+				help["ecoflow_input_volts"],
+				`ecoflow_input_volts{channel="ac",description="X52",sn="X52"} 230`,
+				`ecoflow_input_volts{channel="solar",description="X52",sn="X52"} 48`,
+				help["ecoflow_output_amps"],
+				`ecoflow_output_amps{channel="dc",description="X52",sn="X52"} 4`,
+				help["ecoflow_output_volts"],
+				`ecoflow_output_volts{channel="dc",description="X52",sn="X52"} 12.5`,
+			},
+		},
+		{
+			// DELTA Pro reports everything in mV and mA
+			sn:   "X53",
+			data: `"model":"DELTA Pro","mppt.inVol":48000,"mppt.inAmp":6000,"inv.invOutVol":240000,"inv.invOutAmp":2000`,
+			expected: []string{
+				help["ecoflow_input_amps"],
+				`ecoflow_input_amps{channel="solar",description="X53",sn="X53"} 6`,
+				help["ecoflow_input_volts"],
+				`ecoflow_input_volts{channel="solar",description="X53",sn="X53"} 48`,
+				help["ecoflow_output_amps"],
+				`ecoflow_output_amps{channel="ac",description="X53",sn="X53"} 2`,
+				help["ecoflow_output_volts"],
+				`ecoflow_output_volts{channel="ac",description="X53",sn="X53"} 240`,
+			},
+		},
+	} {
+		api.setQuota(test.sn, `{"code":"0","message":"Success","data":{`+test.data+`}}`)
+		exporter, err := CreateExporters(api.device(test.sn), api.options())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := strings.Join(test.expected, "\n") + "\n"
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_input_volts", "ecoflow_input_amps", "ecoflow_output_volts", "ecoflow_output_amps"); err != nil {
+			t.Errorf("%s: %s", test.sn, err)
+		}
+	}
+}
+
+func TestSolarInputs(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X61", `{"code":"0","message":"Success","data":{"model":"PowerStream",`+
+		`"20_1.pv1InputWatts":1540,"20_1.pv1InputVolt":345,"20_1.pv1InputCur":44,`+
+		`"20_1.pv2InputWatts":1210,"20_1.pv2InputVolt":300,"20_1.pv2InputCur":440}}`)
+
+	exporter, err := CreateExporters(api.device("X61"), api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP ecoflow_solar_input_amps Solar input current by PV input
+# TYPE ecoflow_solar_input_amps gauge
+ecoflow_solar_input_amps{description="X61",pv="1",sn="X61"} 4.4
+ecoflow_solar_input_amps{description="X61",pv="2",sn="X61"} 44
+# HELP ecoflow_solar_input_volts Solar input voltage by PV input
+# TYPE ecoflow_solar_input_volts gauge
+ecoflow_solar_input_volts{description="X61",pv="1",sn="X61"} 34.5
+ecoflow_solar_input_volts{description="X61",pv="2",sn="X61"} 30
+# HELP ecoflow_solar_input_watts Solar input power by PV input
+# TYPE ecoflow_solar_input_watts gauge
+ecoflow_solar_input_watts{description="X61",pv="1",sn="X61"} 154
+ecoflow_solar_input_watts{description="X61",pv="2",sn="X61"} 121
+`
+	// the PowerStream reports no generation total
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_solar_input_watts", "ecoflow_solar_input_volts", "ecoflow_solar_input_amps", "ecoflow_solar_generated_wh_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSolarGenerated(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	exporter, err := CreateExporters(api.device("X62"), api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the device resets its total between the second and third poll
+	for _, step := range []struct {
+		total, counter string
+	}{
+		{"100", "100"},
+		{"250", "250"},
+		{"20", "270"},
+		{"50", "300"},
+	} {
+		api.setQuota("X62", `{"code":"0","message":"Success","data":{"model":"DELTA 2","pd.chgSunPower":`+step.total+`}}`)
+		expected := `
+# HELP ecoflow_solar_generated_wh_total Solar energy generated as reported by the device, device resets don't decrease it
+# TYPE ecoflow_solar_generated_wh_total counter
+ecoflow_solar_generated_wh_total{description="X62",sn="X62"} ` + step.counter + "\n"
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_solar_generated_wh_total"); err != nil {
+			t.Errorf("device total %s: %s", step.total, err)
+		}
+	}
+}
+
+func TestSolarChargeEfficiency(t *testing.T) {
+	for _, test := range []struct {
+		sn, data, expected string
+	}{
+		{"X73", `"mppt.inWatts":200,"bms_bmsStatus.inputWatts":150`, `ecoflow_solar_charge_efficiency{description="X73",sn="X73"} 0.75` + "\n"},
+		{"X74", `"mppt.inWatts":0,"bms_bmsStatus.inputWatts":0`, `ecoflow_solar_charge_efficiency{description="X74",sn="X74"} NaN` + "\n"},
+		{"X75", `"mppt.inWatts":200`, ""},
+	} {
+		api := newMockApi(t, "key", "secret")
+		exporter, err := CreateExporters(api.device(test.sn), api.options())
+		if err != nil {
+			t.Fatal(err)
+		}
+		api.setQuota(test.sn, `{"code":"0","message":"Success","data":{"model":"DELTA 2",`+test.data+`}}`)
+		expected := ""
+		if test.expected != "" {
+			expected = `
+# HELP ecoflow_solar_charge_efficiency Battery charge watts per solar input watts of the same poll, a derived estimate that counts other charge sources too, NaN without solar input
+# TYPE ecoflow_solar_charge_efficiency gauge
+` + test.expected
+		}
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_solar_charge_efficiency"); err != nil {
+			t.Errorf("%s: %s", test.sn, err)
+		}
+	}
+}
+
+func TestAcOutputTarget(t *testing.T) {
+	for _, test := range []struct {
+		sn, model, expected string
+	}{
+		{"X77", "DELTA 2", `
+# HELP ecoflow_ac_output_target_frequency AC output frequency in Hz the inverter is configured for, only for models with a configurable output
+# TYPE ecoflow_ac_output_target_frequency gauge
+ecoflow_ac_output_target_frequency{description="X77",sn="X77"} 50
+# HELP ecoflow_ac_output_target_voltage AC output voltage the inverter is configured for, only for models with a configurable output
+# TYPE ecoflow_ac_output_target_voltage gauge
+ecoflow_ac_output_target_voltage{description="X77",sn="X77"} 230
+`},
+		// the micro inverter follows the grid
+		{"X78", "POWERSTREAM", ""},
+	} {
+		api := newMockApi(t, "key", "secret")
+		exporter, err := CreateExporters(api.device(test.sn), api.options())
+		if err != nil {
+			t.Fatal(err)
+		}
+		api.setQuota(test.sn, `{"code":"0","message":"Success","data":{"model":"`+test.model+`","inv.cfgAcOutVol":230000,"inv.cfgAcOutFreq":50}}`)
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(test.expected), "ecoflow_ac_output_target_voltage", "ecoflow_ac_output_target_frequency"); err != nil {
+			t.Errorf("%s: %s", test.model, err)
+		}
+	}
+}
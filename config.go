@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// reservedLabels are set by the exporter on some metrics and can't be used as
+// common or device labels
+var reservedLabels = []string{"model", "account", "link_group", "channel", "bms", "message", "pv", "port", "firmware", "alias"}
+
+// Config is the config file. It is either just the devices or a map with the
+// devices and the settings shared by all of them.
+type Config struct {
+	CommonLabels map[string]string      `yaml:"commonLabels"`
+	Credentials  map[string]Credentials `yaml:"credentials"`
+	Devices      deviceList             `yaml:"devices"`
+
+	// Layouts and Models are added over the model table of models.yaml
+	Layouts map[string]electricalMeters `yaml:"layouts"`
+	Models  map[string]string           `yaml:"models"`
+
+	// models is the table of models.yaml with Layouts and Models added
+	models *modelTable
+}
+
+// Credentials are the API keys of an account, shared by the devices referencing
+// it with account:
+type Credentials struct {
+	AppKey        string `yaml:"appKey"`
+	SecretKey     string `yaml:"secretKey"`
+	AppKeyFile    string `yaml:"appKeyFile"`
+	SecretKeyFile string `yaml:"secretKeyFile"`
+}
+
+// envReference is a ${NAME} reference to an environment variable in a key
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// resolveKey returns the key read from file if given, otherwise the value with
+// its ${NAME} references replaced by the environment variables. An unset
+// variable or an unreadable file is an error.
+func resolveKey(name, value, file string) (string, error) {
+	if file != "" {
+		if value != "" {
+			return "", fmt.Errorf("both %s and %sFile are set", name, name)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("couldn't read %sFile: %w", name, err)
+		}
+		// secret files usually end with a newline
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	var err error
+	value = envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		variable := envReference.FindStringSubmatch(reference)[1]
+		expanded, ok := os.LookupEnv(variable)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s of %s is not set", variable, name)
+		}
+		return expanded
+	})
+	return value, err
+}
+
+// resolve reads the keys of the account from their files or the environment
+func (credentials *Credentials) resolve() error {
+	var err error
+	if credentials.AppKey, err = resolveKey("appKey", credentials.AppKey, credentials.AppKeyFile); err != nil {
+		return err
+	}
+	credentials.SecretKey, err = resolveKey("secretKey", credentials.SecretKey, credentials.SecretKeyFile)
+	return err
+}
+
+// deviceList is given either as a list of devices or as a map from serial number
+// to device
+type deviceList []Ecoflow
+
+func (devices *deviceList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []Ecoflow
+	var nodes []interface{}
+	if err := unmarshal(&nodes); err == nil {
+		// a list, its errors are about the devices themselves
+		if err := unmarshal(&list); err != nil {
+			return err
+		}
+		*devices = list
+		return nil
+	}
+
+	var byKey map[string]interface{}
+	if err := unmarshal(&byKey); err != nil {
+		return errors.New("devices must be a list of devices or a map keyed by serial number")
+	}
+	var bySerial map[string]Ecoflow
+	if err := unmarshal(&bySerial); err != nil {
+		return err
+	}
+
+	serials := make([]string, 0, len(bySerial))
+	for sn := range bySerial {
+		serials = append(serials, sn)
+	}
+	sort.Strings(serials)
+
+	list = make([]Ecoflow, 0, len(bySerial))
+	for _, sn := range serials {
+		device := bySerial[sn]
+		if device.SerialNumber == "" {
+			device.SerialNumber = sn
+		} else if device.SerialNumber != sn {
+			return fmt.Errorf("serialNumber %q of device %q doesn't match its key", device.SerialNumber, sn)
+		}
+		list = append(list, device)
+	}
+	*devices = list
+	return nil
+}
+
+func (config *Config) load(data []byte) error {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return err
+	}
+
+	switch document := document.(type) {
+	case nil:
+		// only comments
+		return nil
+	case []interface{}:
+		return yaml.Unmarshal(data, &config.Devices)
+	case map[interface{}]interface{}:
+		_, hasDevices := document["devices"]
+		_, hasLabels := document["commonLabels"]
+		_, hasCredentials := document["credentials"]
+		_, hasLayouts := document["layouts"]
+		_, hasModels := document["models"]
+		if !hasDevices && !hasLabels && !hasCredentials && !hasLayouts && !hasModels {
+			// a map of devices keyed by serial number
+			return yaml.Unmarshal(data, &config.Devices)
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return err
+		}
+		return validateLabelNames(config.CommonLabels)
+	default:
+		return errors.New("config must be a list of devices, a map keyed by serial number or a map with devices")
+	}
+}
+
+// validateLabelNames checks the label names against the reserved ones and
+// the extra reserved names
+func validateLabelNames(labels map[string]string, extra ...string) error {
+	for name := range labels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		for _, reserved := range append(reservedLabels, extra...) {
+			if name == reserved {
+				return fmt.Errorf("label name %q is reserved", name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateConfig checks every device for the fields the API needs and for
+// duplicate serial numbers, and reports all problems at once. Entries without
+// serialNumber are discovered with the device list API.
+func validateConfig(devices []Ecoflow) error {
+	var problems []string
+	seen := make(map[string]int)
+	for i, device := range devices {
+		name := entryName(i, device)
+
+		if device.AppKey == "" {
+			problems = append(problems, name+": missing appKey")
+		}
+		if device.SecretKey == "" {
+			problems = append(problems, name+": missing secretKey")
+		}
+		if device.Transport != "" && device.Transport != transportHttp && device.Transport != transportMqtt {
+			problems = append(problems, fmt.Sprintf("%s: unknown transport %q", name, device.Transport))
+		}
+		if len(device.Quotas) > 0 && device.Transport == transportMqtt {
+			problems = append(problems, name+": quotas only apply to transport http")
+		}
+		// unlike the common labels, these would silently lose against the device
+		if err := validateLabelNames(device.Labels, "sn", "description"); err != nil {
+			problems = append(problems, name+": "+err.Error())
+		}
+		if device.CheckTimeout < 0 {
+			problems = append(problems, name+": checkTimeout must not be negative")
+		}
+		if device.AttemptTimeout < 0 {
+			problems = append(problems, name+": attemptTimeout must not be negative")
+		}
+		if device.AttemptTimeoutMultiplier != 0 && device.AttemptTimeoutMultiplier < 1 {
+			problems = append(problems, name+": attemptTimeoutMultiplier must be at least 1")
+		}
+		keys := make([]string, 0, len(device.MetricTypes))
+		for key := range device.MetricTypes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if metricType := device.MetricTypes[key]; metricType != metricTypeGauge && metricType != metricTypeCounter {
+				problems = append(problems, fmt.Sprintf("%s: metricTypes %s must be gauge or counter, not %q", name, key, metricType))
+			}
+		}
+
+		if device.SerialNumber == "" {
+			continue
+		}
+		if first, ok := seen[device.SerialNumber]; ok {
+			problems = append(problems, fmt.Sprintf("%s: serialNumber %s already used by device %d", name, device.SerialNumber, first))
+			continue
+		}
+		seen[device.SerialNumber] = i
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// readConfig parses the config file, or every *.yaml and *.yml file if path is
+// a directory
+func readConfig(path string) (Config, error) {
+	var config Config
+	info, err := os.Stat(path)
+	if err != nil {
+		return config, fmt.Errorf("couldn't read config: %w", err)
+	}
+	if !info.IsDir() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, fmt.Errorf("couldn't read config: %w", err)
+		}
+		if err := config.load(data); err != nil {
+			return config, fmt.Errorf("couldn't parse config: %w", err)
+		}
+		return config, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.yaml"))
+	if err != nil {
+		return config, fmt.Errorf("couldn't read config: %w", err)
+	}
+	yml, err := filepath.Glob(filepath.Join(path, "*.yml"))
+	if err != nil {
+		return config, fmt.Errorf("couldn't read config: %w", err)
+	}
+	files = append(files, yml...)
+	sort.Strings(files)
+
+	sources := make(map[string]string)
+	for _, file := range files {
+		var part Config
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return config, fmt.Errorf("couldn't read config: %w", err)
+		}
+		if err := part.load(data); err != nil {
+			return config, fmt.Errorf("couldn't parse config: %s: %w", file, err)
+		}
+		if err := config.merge(part, file, sources); err != nil {
+			return config, fmt.Errorf("invalid config: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// merge adds the devices, accounts and common labels of the config file to
+// config. sources remembers the file of every serial number, account and label
+// so conflicts name both files.
+func (config *Config) merge(part Config, file string, sources map[string]string) error {
+	for _, device := range part.Devices {
+		if device.SerialNumber != "" {
+			key := "serialNumber " + device.SerialNumber
+			if first, ok := sources[key]; ok {
+				return fmt.Errorf("%s of %s already used in %s", key, file, first)
+			}
+			sources[key] = file
+		}
+		config.Devices = append(config.Devices, device)
+	}
+
+	for name, credentials := range part.Credentials {
+		key := "account " + name
+		if first, ok := sources[key]; ok {
+			return fmt.Errorf("%s of %s already defined in %s", key, file, first)
+		}
+		sources[key] = file
+		if config.Credentials == nil {
+			config.Credentials = make(map[string]Credentials)
+		}
+		config.Credentials[name] = credentials
+	}
+
+	for name, value := range part.CommonLabels {
+		key := "common label " + name
+		if current, ok := config.CommonLabels[name]; ok && current != value {
+			return fmt.Errorf("%s of %s differs from %s", key, file, sources[key])
+		}
+		sources[key] = file
+		if config.CommonLabels == nil {
+			config.CommonLabels = make(map[string]string)
+		}
+		config.CommonLabels[name] = value
+	}
+
+	for name, layout := range part.Layouts {
+		key := "layout " + name
+		if first, ok := sources[key]; ok {
+			return fmt.Errorf("%s of %s already defined in %s", key, file, first)
+		}
+		sources[key] = file
+		if config.Layouts == nil {
+			config.Layouts = make(map[string]electricalMeters)
+		}
+		config.Layouts[name] = layout
+	}
+
+	for model, layout := range part.Models {
+		key := "model " + strings.ToUpper(model)
+		if first, ok := sources[key]; ok {
+			return fmt.Errorf("%s of %s already defined in %s", key, file, first)
+		}
+		sources[key] = file
+		if config.Models == nil {
+			config.Models = make(map[string]string)
+		}
+		config.Models[model] = layout
+	}
+	return nil
+}
+
+// loadConfig reads and validates the config file or directory, the devices come
+// with their defaults set
+func loadConfig(path string) (Config, error) {
+	config, err := readConfig(path)
+	if err != nil {
+		return config, err
+	}
+	for name, credentials := range config.Credentials {
+		if err := credentials.resolve(); err != nil {
+			return config, fmt.Errorf("invalid config: account %s: %w", name, err)
+		}
+		config.Credentials[name] = credentials
+	}
+	for i := range config.Devices {
+		if err := config.Devices[i].defaults(config.Credentials); err != nil {
+			return config, fmt.Errorf("invalid config: %w", err)
+		}
+	}
+	// the keys are checked after the accounts are resolved
+	if err := validateConfig(config.Devices); err != nil {
+		return config, fmt.Errorf("invalid config: %w", err)
+	}
+	models, err := defaultModels.with(modelTable{Layouts: config.Layouts, Models: config.Models})
+	if err != nil {
+		return config, fmt.Errorf("invalid config: %w", err)
+	}
+	config.models = &models
+	return config, nil
+}
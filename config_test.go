@@ -0,0 +1,286 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeviceListShapes(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		config  string
+		serials string
+		err     string
+	}{
+		{
+			name:    "list",
+			config:  "- serialNumber: A1\n  appKey: k\n- serialNumber: B2\n  appKey: k\n",
+			serials: "A1 B2",
+		},
+		{
+			name:    "map",
+			config:  "B2:\n  appKey: k\nA1:\n  appKey: k\n  serialNumber: A1\n",
+			serials: "A1 B2",
+		},
+		{
+			name:    "devices list",
+			config:  "devices:\n  - serialNumber: A1\n",
+			serials: "A1",
+		},
+		{
+			name:    "devices map",
+			config:  "devices:\n  A1:\n    appKey: k\n",
+			serials: "A1",
+		},
+		{
+			name:   "key mismatch",
+			config: "A1:\n  serialNumber: B2\n",
+			err:    `serialNumber "B2" of device "A1" doesn't match its key`,
+		},
+		{
+			name:   "scalar",
+			config: "devices: A1\n",
+			err:    "devices must be a list of devices or a map keyed by serial number",
+		},
+		{
+			name:   "top level scalar",
+			config: "A1\n",
+			err:    "config must be a list of devices",
+		},
+	} {
+		var config Config
+		err := config.load([]byte(test.config))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		var serials []string
+		for _, device := range config.Devices {
+			serials = append(serials, device.SerialNumber)
+		}
+		if got := strings.Join(serials, " "); got != test.serials {
+			t.Errorf("%s: got devices %s, want %s", test.name, got, test.serials)
+		}
+	}
+}
+
+// writeConfig writes a config file to a temporary directory and returns its path
+func writeConfig(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigCreatesExporters(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X23", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.setQuota("X24", `{"code":"0","message":"Success","data":{"soc":60}}`)
+
+	path := writeConfig(t, "- serialNumber: X23\n  appKey: key\n  secretKey: secret\n- serialNumber: X24\n  appKey: key\n  secretKey: secret\n")
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := newTestSet(t, config.Devices, api.options())
+	if len(set.exporters) != 2 {
+		t.Fatalf("got %d exporters, want 2", len(set.exporters))
+	}
+	for _, sn := range []string{"X23", "X24"} {
+		if _, ok := set.get(sn); !ok {
+			t.Errorf("no exporter for %s", sn)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		devices []Ecoflow
+		err     string
+	}{
+		{
+			name:    "valid",
+			devices: []Ecoflow{{SerialNumber: "A1", AppKey: "k", SecretKey: "s"}, {AppKey: "k", SecretKey: "s"}},
+		},
+		{
+			name:    "missing appKey",
+			devices: []Ecoflow{{SerialNumber: "A1", SecretKey: "s", Description: "garage"}},
+			err:     "device 0 (garage): missing appKey",
+		},
+		{
+			name:    "missing secretKey",
+			devices: []Ecoflow{{SerialNumber: "A1", AppKey: "k"}},
+			err:     "device 0: missing secretKey",
+		},
+		{
+			name:    "missing both keys",
+			devices: []Ecoflow{{SerialNumber: "A1"}},
+			err:     "device 0: missing appKey; device 0: missing secretKey",
+		},
+		{
+			name:    "attempt timeout multiplier below 1",
+			devices: []Ecoflow{{SerialNumber: "A1", AppKey: "k", SecretKey: "s", AttemptTimeoutMultiplier: 0.5}},
+			err:     "device 0: attemptTimeoutMultiplier must be at least 1",
+		},
+		{
+			name:    "unknown metric type",
+			devices: []Ecoflow{{SerialNumber: "A1", AppKey: "k", SecretKey: "s", MetricTypes: map[string]string{"pd.chgPowerAc": "histogram"}}},
+			err:     `device 0: metricTypes pd.chgPowerAc must be gauge or counter, not "histogram"`,
+		},
+		{
+			name: "duplicate serial",
+			devices: []Ecoflow{
+				{SerialNumber: "A1", AppKey: "k", SecretKey: "s"},
+				{SerialNumber: "B2", AppKey: "k", SecretKey: "s"},
+				{SerialNumber: "A1", AppKey: "k", SecretKey: "s"},
+			},
+			err: "device 2: serialNumber A1 already used by device 0",
+		},
+		{
+			name: "all problems at once",
+			devices: []Ecoflow{
+				{SerialNumber: "A1", AppKey: "k"},
+				{SerialNumber: "A1", SecretKey: "s"},
+			},
+			err: "device 0: missing secretKey; device 1: missing appKey; device 1: serialNumber A1 already used by device 0",
+		},
+	} {
+		err := validateConfig(test.devices)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, `
+credentials:
+  home:
+    appKey: home-key
+    secretKey: home-secret
+devices:
+  - serialNumber: A1
+    account: home
+  - serialNumber: B2
+    account: home
+    secretKey: own-secret
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct{ appKey, secretKey string }{
+		{"home-key", "home-secret"},
+		// keys of the device win over the account ones
+		{"home-key", "own-secret"},
+	} {
+		device := config.Devices[i]
+		if device.AppKey != want.appKey || device.SecretKey != want.secretKey {
+			t.Errorf("%s: got keys %s/%s, want %s/%s", device.SerialNumber, device.AppKey, device.SecretKey, want.appKey, want.secretKey)
+		}
+	}
+
+	_, err = loadConfig(writeConfig(t, "devices:\n  - serialNumber: A1\n    account: office\n"))
+	if err == nil || !strings.Contains(err.Error(), `unknown account "office" of device A1`) {
+		t.Errorf("got error %v for a missing account, want unknown account", err)
+	}
+}
+
+func TestResolveKey(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "secret")
+	if err := os.WriteFile(file, []byte("file-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ECOFLOW_TEST_SECRET", "env-secret")
+
+	for _, test := range []struct {
+		name, value, file string
+		want, err         string
+	}{
+		{name: "plain", value: "plain-secret", want: "plain-secret"},
+		{name: "file", file: file, want: "file-secret"},
+		{name: "env", value: "${ECOFLOW_TEST_SECRET}", want: "env-secret"},
+		{name: "env in value", value: "prefix-${ECOFLOW_TEST_SECRET}", want: "prefix-env-secret"},
+		{name: "unset env", value: "${ECOFLOW_TEST_UNSET}", err: "environment variable ECOFLOW_TEST_UNSET of secretKey is not set"},
+		{name: "unreadable file", file: filepath.Join(dir, "missing"), err: "couldn't read secretKeyFile"},
+		{name: "value and file", value: "plain-secret", file: file, err: "both secretKey and secretKeyFile are set"},
+	} {
+		got, err := resolveKey("secretKey", test.value, test.file)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// the keys of the devices are resolved while loading the config
+	config, err := loadConfig(writeConfig(t, "- serialNumber: A1\n  appKey: ${ECOFLOW_TEST_SECRET}\n  secretKeyFile: "+file+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device := config.Devices[0]; device.AppKey != "env-secret" || device.SecretKey != "file-secret" {
+		t.Errorf("got keys %s/%s, want env-secret/file-secret", device.AppKey, device.SecretKey)
+	}
+	if _, err := loadConfig(writeConfig(t, "- serialNumber: A1\n  appKey: ${ECOFLOW_TEST_UNSET}\n  secretKey: s\n")); err == nil {
+		t.Error("config with an unset environment variable loaded")
+	}
+}
+
+func TestReadConfigDirectory(t *testing.T) {
+	write := func(dir, name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	dir := t.TempDir()
+	write(dir, "home.yaml", "credentials:\n  home:\n    appKey: k\n    secretKey: s\ndevices:\n  - serialNumber: A1\n    account: home\n")
+	write(dir, "garage.yml", "- serialNumber: B2\n  account: home\n")
+	// other files are ignored
+	write(dir, "README", "not a config")
+
+	config, err := loadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serials []string
+	for _, device := range config.Devices {
+		serials = append(serials, device.SerialNumber+"/"+device.AppKey)
+	}
+	// the files are read in name order
+	if got := strings.Join(serials, " "); got != "B2/k A1/k" {
+		t.Errorf("got devices %s, want B2/k A1/k", got)
+	}
+
+	duplicate := write(dir, "home2.yaml", "- serialNumber: A1\n  account: home\n")
+	_, err = readConfig(dir)
+	want := "serialNumber A1 of " + duplicate + " already used in " + filepath.Join(dir, "home.yaml")
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v for a duplicate device, want %q", err, want)
+	}
+}
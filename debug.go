@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// debugResponse is the last API response of a device as served on
+// /debug/devices/<sn>
+type debugResponse struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	// Body is the raw response, kept as a string since it may not be JSON
+	Body string `json:"body"`
+}
+
+// debugHandler serves the last API response of the device given by the path
+// after prefix
+func debugHandler(devices *exporterSet, prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		exporter, ok := devices.get(strings.TrimPrefix(r.URL.Path, prefix))
+		if !ok {
+			http.Error(w, "unknown device", http.StatusNotFound)
+			return
+		}
+
+		exporter.mutex.RLock()
+		response := exporter.lastResponse
+		exporter.mutex.RUnlock()
+		if response.Time.IsZero() {
+			http.Error(w, "no response yet", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	body := `{"code":"0","message":"Success","data":{"soc":50}}`
+	api.setQuota("X54", body)
+	clock := newFakeClock()
+	options := api.options()
+	options.DebugEndpoint = true
+	options.Now = clock.Now
+	set := newTestSet(t, []Ecoflow{api.device("X54")}, options)
+	handler := debugHandler(set, "/debug/devices/")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	if rec := get("/debug/devices/X54"); rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d before the first scrape, want 404", rec.Code)
+	}
+	if rec := get("/debug/devices/unknown"); rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown device, want 404", rec.Code)
+	}
+
+	if _, err := set.gatherer(context.Background()).Gather(); err != nil {
+		t.Fatal(err)
+	}
+	rec := get("/debug/devices/X54")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d after a scrape, want 200", rec.Code)
+	}
+	var response debugResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || response.Body != body || response.Error != "" || !response.Time.Equal(clock.Now()) {
+		t.Errorf("got %+v, want status 200, the raw body and the time of the exporter clock", response)
+	}
+}
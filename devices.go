@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// exporterSet holds the device exporters by serial number. It is filled by the
+// startup sequence and config reloads, and read by the HTTP handlers, which may
+// already be serving.
+type exporterSet struct {
+	mutex     sync.RWMutex
+	exporters map[string]*EcoflowExporter
+	groups    []*LinkGroupExporter
+	// registry only checks the devices and groups for conflicts, the metrics
+	// are gathered per scrape request by gatherer
+	registry *prometheus.Registry
+}
+
+func (set *exporterSet) get(sn string) (*EcoflowExporter, bool) {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	exporter, ok := set.exporters[sn]
+	return exporter, ok
+}
+
+// update creates the exporters of new and changed devices and drops the ones
+// of removed devices. Unchanged devices keep their exporter and state. A device
+// whose exporter can't be created or registered is skipped with a warning, a
+// changed one keeps running with its previous settings. The error is only
+// returned if none of the devices is left.
+func (set *exporterSet) update(ctx context.Context, devices []Ecoflow, options ExporterOptions) error {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	if set.registry == nil {
+		set.registry = prometheus.NewRegistry()
+	}
+	exporters := make(map[string]*EcoflowExporter, len(devices))
+	var created []*EcoflowExporter
+	for _, ecoflow := range devices {
+		old, ok := set.exporters[ecoflow.SerialNumber]
+		if ok && sameDevice(*old.ecoflow, ecoflow) &&
+			reflect.DeepEqual(old.options.CommonLabels, options.CommonLabels) &&
+			reflect.DeepEqual(old.options.Models, options.Models) {
+			if ecoflow.Online != nil {
+				old.mutex.Lock()
+				old.setOnline(*ecoflow.Online)
+				old.mutex.Unlock()
+			}
+			exporters[ecoflow.SerialNumber] = old
+			continue
+		}
+		exporter, err := CreateExporters(ecoflow, options)
+		if err != nil {
+			slog.Warn("Couldn't create device exporter", "sn", ecoflow.SerialNumber, "error", err)
+			if ok {
+				exporters[ecoflow.SerialNumber] = old
+			}
+			continue
+		}
+		exporters[ecoflow.SerialNumber] = exporter
+		created = append(created, exporter)
+	}
+
+	// groups are rebuilt from the new members
+	for _, group := range set.groups {
+		set.registry.Unregister(group)
+	}
+	set.groups = nil
+	// removed devices go first, changed ones once their new exporter is in place
+	for sn, old := range set.exporters {
+		if _, ok := exporters[sn]; ok {
+			continue
+		}
+		old.unregister(set.registry)
+		apiRequestDuration.DeletePartialMatch(prometheus.Labels{"sn": sn})
+		scrapeSlotWait.DeleteLabelValues(sn)
+		cacheHits.DeleteLabelValues(sn)
+		go old.shutdown()
+	}
+
+	for _, exporter := range created {
+		sn := exporter.ecoflow.SerialNumber
+		old, changed := set.exporters[sn]
+		if changed {
+			old.unregister(set.registry)
+		}
+		if err := exporter.register(set.registry); err != nil {
+			slog.Warn("Couldn't register device", "sn", sn, "error", err)
+			delete(exporters, sn)
+			if changed {
+				if err := old.register(set.registry); err != nil {
+					slog.Warn("Couldn't register device", "sn", sn, "error", err)
+					go old.shutdown()
+					continue
+				}
+				exporters[sn] = old
+			}
+			continue
+		}
+		if changed {
+			go old.shutdown()
+		}
+		exporter.start(ctx)
+	}
+
+	linkGroups := make(map[string][]*EcoflowExporter)
+	configDevices.Reset()
+	for _, exporter := range exporters {
+		configDevices.WithLabelValues(exporter.ecoflow.LinkGroup, exporter.ecoflow.Model).Inc()
+		if exporter.ecoflow.LinkGroup != "" {
+			linkGroups[exporter.ecoflow.LinkGroup] = append(linkGroups[exporter.ecoflow.LinkGroup], exporter)
+		}
+	}
+	for name, members := range linkGroups {
+		group := CreateLinkGroupExporter(name, members, options.CommonLabels)
+		if err := set.registry.Register(group); err != nil {
+			slog.Warn("Couldn't register link group", "link_group", name, "error", err)
+			continue
+		}
+		set.groups = append(set.groups, group)
+	}
+
+	set.exporters = exporters
+	if len(devices) > 0 && len(exporters) == 0 {
+		return errors.New("none of the devices could be registered")
+	}
+	return nil
+}
+
+// sameDevice tells if the config of a device is unchanged, the online flag of
+// the device list is no setting
+func sameDevice(a, b Ecoflow) bool {
+	a.Online, b.Online = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// shutdown stops the background goroutines of all devices, waiting at most
+// until ctx is done
+func (set *exporterSet) shutdown(ctx context.Context) error {
+	set.mutex.RLock()
+	var wg sync.WaitGroup
+	for _, exporter := range set.exporters {
+		wg.Add(1)
+		go func(exporter *EcoflowExporter) {
+			defer wg.Done()
+			exporter.shutdown()
+		}(exporter)
+	}
+	set.mutex.RUnlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// contextScraper is a collector that can be bound to the context of a scrape
+// request
+type contextScraper interface {
+	Describe(ch chan<- *prometheus.Desc)
+	scrape(ctx context.Context, ch chan<- prometheus.Metric)
+}
+
+// scrapeCollector collects a device or link group with the context of the
+// scrape request, so a canceled scrape cancels the API requests
+type scrapeCollector struct {
+	ctx       context.Context
+	collector contextScraper
+}
+
+// orderedCollector is a scrapeCollector of a device with a turn in the scrape
+// order, a device done without an API request passes its turn on
+type orderedCollector struct {
+	scrapeCollector
+	exporter *EcoflowExporter
+}
+
+func (c orderedCollector) Collect(ch chan<- prometheus.Metric) {
+	defer passScrapeTurn(c.ctx, c.exporter.ecoflow.SerialNumber)
+	c.scrapeCollector.Collect(ch)
+}
+
+func (c scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.collector.Describe(ch)
+}
+
+func (c scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collector.scrape(c.ctx, ch)
+}
+
+// gatherer returns a registry with the devices and link groups bound to ctx
+func (set *exporterSet) gatherer(ctx context.Context) prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	// the members of a group that couldn't be registered are never collected,
+	// they get no turn
+	exporters := make([]*EcoflowExporter, 0, len(set.exporters))
+	for _, exporter := range set.exporters {
+		if exporter.ecoflow.LinkGroup == "" {
+			exporters = append(exporters, exporter)
+		}
+	}
+	for _, group := range set.groups {
+		exporters = append(exporters, group.members...)
+	}
+	// the devices get the request slots by priority, link group members too
+	sortByPriority(exporters)
+	order := newScrapeOrder(exporters)
+	ctx = withScrapeOrder(ctx, order)
+	// devices on their own registry were only checked against themselves
+	for _, exporter := range exporters {
+		if exporter.ecoflow.LinkGroup != "" {
+			continue
+		}
+		collector := orderedCollector{scrapeCollector{ctx, exporter}, exporter}
+		if err := registry.Register(collector); err != nil {
+			order.pass(exporter.ecoflow.SerialNumber)
+			slog.Warn("Couldn't gather device", "sn", exporter.ecoflow.SerialNumber, "error", err)
+		}
+	}
+	for _, group := range set.groups {
+		registry.MustRegister(scrapeCollector{ctx, group})
+	}
+	return registry
+}
+
+// metricsHandler serves the default registry and the devices, collected with
+// the context of the request
+func metricsHandler(set *exporterSet, opts promhttp.HandlerOpts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, set.gatherer(r.Context())}
+		promhttp.HandlerFor(gatherers, opts).ServeHTTP(w, r)
+	}
+}
+
+// deviceMetricsHandler serves prefix<sn> from the registry of the device
+func deviceMetricsHandler(set *exporterSet, prefix string, opts promhttp.HandlerOpts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		exporter, ok := set.get(strings.TrimPrefix(r.URL.Path, prefix))
+		if !ok || exporter.registry == nil {
+			http.NotFound(w, r)
+			return
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(scrapeCollector{r.Context(), exporter})
+		promhttp.HandlerFor(registry, opts).ServeHTTP(w, r)
+	}
+}
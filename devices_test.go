@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestSet returns an exporter set running the devices
+func newTestSet(t *testing.T, devices []Ecoflow, options ExporterOptions) *exporterSet {
+	set := &exporterSet{}
+	if err := set.update(context.Background(), devices, options); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { set.shutdown(context.Background()) })
+	return set
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X13", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	set := newTestSet(t, []Ecoflow{api.device("X13")}, api.options())
+
+	for _, test := range []struct {
+		disableOpenMetrics bool
+		contentType        string
+	}{
+		{false, "application/openmetrics-text"},
+		{true, "text/plain"},
+	} {
+		handler := metricsHandler(set, promhttp.HandlerOpts{EnableOpenMetrics: !test.disableOpenMetrics})
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, test.contentType) {
+			t.Errorf("disable-openmetrics %v: got Content-Type %s, want %s", test.disableOpenMetrics, contentType, test.contentType)
+		}
+		if !strings.Contains(rec.Body.String(), `ecoflow_soc{description="X13",sn="X13"} 50`) {
+			t.Errorf("disable-openmetrics %v: device metrics missing:\n%s", test.disableOpenMetrics, rec.Body)
+		}
+	}
+}
+
+func TestConcurrentScrapes(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setDelay(200 * time.Millisecond)
+	var devices []Ecoflow
+	for i := 0; i < 10; i++ {
+		sn := fmt.Sprintf("C%d", i)
+		api.setQuota(sn, `{"code":"0","message":"Success","data":{"soc":50}}`)
+		devices = append(devices, api.device(sn))
+	}
+
+	for _, test := range []struct {
+		maxConcurrent int
+		min, max      time.Duration
+	}{
+		// all devices at once take one API delay, not ten
+		{10, 200 * time.Millisecond, 600 * time.Millisecond},
+		// two at a time take five
+		{2, time.Second, 1400 * time.Millisecond},
+	} {
+		options := api.options()
+		options.Semaphore = make(chan struct{}, test.maxConcurrent)
+		set := newTestSet(t, devices, options)
+
+		start := time.Now()
+		if _, err := set.gatherer(context.Background()).Gather(); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < test.min || elapsed > test.max {
+			t.Errorf("max-concurrent-scrapes %d: 10 devices took %s, want between %s and %s", test.maxConcurrent, elapsed, test.min, test.max)
+		}
+	}
+}
+
+func TestScrapePriority(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setDelay(20 * time.Millisecond)
+	var devices []Ecoflow
+	for sn, priority := range map[string]int{"X80": 0, "X81": 5, "X82": 1, "X83": 5} {
+		api.setQuota(sn, `{"code":"0","message":"Success","data":{"soc":50}}`)
+		device := api.device(sn)
+		device.Priority = priority
+		devices = append(devices, device)
+	}
+	options := api.options()
+	options.Semaphore = make(chan struct{}, 1)
+	set := newTestSet(t, devices, options)
+
+	if _, err := set.gatherer(context.Background()).Gather(); err != nil {
+		t.Fatal(err)
+	}
+	serials := []string{"X80", "X81", "X82", "X83"}
+	sort.Slice(serials, func(i, j int) bool { return api.firstRequest(serials[i]).Before(api.firstRequest(serials[j])) })
+	// equal priorities go by serial number
+	if got := strings.Join(serials, " "); got != "X81 X83 X82 X80" {
+		t.Errorf("got request order %s, want X81 X83 X82 X80", got)
+	}
+}
+
+func TestScrapePriorityLinkGroup(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setDelay(20 * time.Millisecond)
+	var devices []Ecoflow
+	for _, test := range []struct {
+		sn        string
+		linkGroup string
+		priority  int
+	}{
+		{"X87", "", 0},
+		{"X88", "home", 9},
+		{"X89", "home", 0},
+		{"X90", "", 5},
+	} {
+		api.setQuota(test.sn, `{"code":"0","message":"Success","data":{"soc":50}}`)
+		device := api.device(test.sn)
+		device.LinkGroup = test.linkGroup
+		device.Priority = test.priority
+		devices = append(devices, device)
+	}
+	options := api.options()
+	options.Semaphore = make(chan struct{}, 1)
+	set := newTestSet(t, devices, options)
+
+	if _, err := set.gatherer(context.Background()).Gather(); err != nil {
+		t.Fatal(err)
+	}
+	serials := []string{"X87", "X88", "X89", "X90"}
+	sort.Slice(serials, func(i, j int) bool { return api.firstRequest(serials[i]).Before(api.firstRequest(serials[j])) })
+	// group members take their turns by their own priority
+	if got := strings.Join(serials, " "); got != "X88 X90 X87 X89" {
+		t.Errorf("got request order %s, want X88 X90 X87 X89", got)
+	}
+}
+
+func TestExporterSetReload(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	for _, sn := range []string{"R1", "R2", "R3"} {
+		api.setQuota(sn, `{"code":"0","message":"Success","data":{"soc":50}}`)
+	}
+	options := api.options()
+	set := newTestSet(t, []Ecoflow{api.device("R1"), api.device("R2")}, options)
+	kept, _ := set.get("R2")
+	if got := gatheredSerials(t, set); got != "R1 R2" {
+		t.Errorf("got devices %s, want R1 R2", got)
+	}
+
+	// R1 is removed and R3 added
+	if err := set.update(context.Background(), []Ecoflow{api.device("R2"), api.device("R3")}, options); err != nil {
+		t.Fatal(err)
+	}
+	if got := gatheredSerials(t, set); got != "R2 R3" {
+		t.Errorf("got devices %s after the reload, want R2 R3", got)
+	}
+	if exporter, _ := set.get("R2"); exporter != kept {
+		t.Error("unchanged device R2 was re-created")
+	}
+
+	// changed credentials re-create the device
+	changed := api.device("R2")
+	changed.SecretKey = "other"
+	if err := set.update(context.Background(), []Ecoflow{changed, api.device("R3")}, options); err != nil {
+		t.Fatal(err)
+	}
+	if exporter, _ := set.get("R2"); exporter == kept {
+		t.Error("device R2 with changed secretKey wasn't re-created")
+	}
+}
+
+func TestExporterSetReloadRegisterFailure(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("R4", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	options := api.options()
+	set := newTestSet(t, []Ecoflow{api.device("R4")}, options)
+	kept, _ := set.get("R4")
+
+	// a collector in the way of the changed device
+	changed := api.device("R4")
+	changed.Description = "moved"
+	set.registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "ecoflow_soc",
+		Help:        "State of charge",
+		ConstLabels: prometheus.Labels{"description": "moved", "sn": "R4"},
+	}))
+	if err := set.update(context.Background(), []Ecoflow{changed}, options); err != nil {
+		t.Fatal(err)
+	}
+
+	// the device keeps running with its previous settings
+	if exporter, _ := set.get("R4"); exporter != kept {
+		t.Fatal("device R4 was dropped or replaced by the exporter that couldn't be registered")
+	}
+	if set.registry.Register(kept) == nil {
+		t.Error("device R4 isn't registered anymore")
+	}
+	if got := gatheredSerials(t, set); got != "R4" {
+		t.Errorf("got devices %s, want R4", got)
+	}
+}
+
+// gatheredSerials returns the sorted serial numbers of the ecoflow_soc series
+func gatheredSerials(t *testing.T, set *exporterSet) string {
+	families, err := set.gatherer(context.Background()).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serials []string
+	for _, family := range families {
+		if family.GetName() != "ecoflow_soc" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "sn" {
+					serials = append(serials, label.GetValue())
+				}
+			}
+		}
+	}
+	sort.Strings(serials)
+	return strings.Join(serials, " ")
+}
+
+func TestScrapeCanceled(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X41", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.setDelay(5 * time.Second)
+	set := newTestSet(t, []Ecoflow{api.device("X41")}, api.options())
+	exporter, _ := set.get("X41")
+
+	// Prometheus gives up on the scrape while the API request is in flight
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx)
+	start := time.Now()
+	metricsHandler(set, promhttp.HandlerOpts{}).ServeHTTP(httptest.NewRecorder(), req)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("canceled scrape took %s", elapsed)
+	}
+
+	for deadline := time.Now().Add(time.Second); api.abortedCount() == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if aborted := api.abortedCount(); aborted != 1 {
+		t.Errorf("got %d aborted API requests, want 1", aborted)
+	}
+	// nobody waits for the result, it is no device failure
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	if lastPoll := testutil.ToFloat64(exporter.lastPoll); lastPoll != 0 {
+		t.Errorf("canceled scrape was stored as a poll at %v", lastPoll)
+	}
+}
+
+func TestDeviceMetricsHandler(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X84", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.setQuota("X85", `{"code":"0","message":"Success","data":{"soc":60}}`)
+	options := api.options()
+	options.PerDeviceRegistry = true
+	linked := api.device("X85")
+	linked.LinkGroup = "home"
+	set := newTestSet(t, []Ecoflow{api.device("X84"), linked}, options)
+	handler := deviceMetricsHandler(set, "/metrics/", promhttp.HandlerOpts{})
+
+	for sn, want := range map[string]string{
+		"X84": `ecoflow_soc{description="X84",sn="X84"} 50`,
+		// link group members have their own registry as well
+		"X85": `ecoflow_soc{description="X85",sn="X85"} 60`,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics/"+sn, nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics/%s: got status %d, want %s in:\n%s", sn, rec.Code, want, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics/X86", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("/metrics/X86: got status %d for an unknown device, want 404", rec.Code)
+	}
+
+	// the group still collects its member on the combined metrics
+	if _, err := set.gatherer(context.Background()).Gather(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConflictingDevice(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X57", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.setQuota("X58", `{"code":"0","message":"Success","data":{"soc":60}}`)
+	logs := captureLogs(t, slog.LevelWarn)
+
+	// both keys would become ecoflow_quota_inv_x
+	conflicting := api.device("X58")
+	conflicting.Metrics = []string{"inv.x", "inv_x"}
+	set := newTestSet(t, []Ecoflow{api.device("X57"), conflicting}, api.options())
+
+	if _, ok := set.get("X58"); ok {
+		t.Error("conflicting device X58 was registered")
+	}
+	if got := gatheredSerials(t, set); got != "X57" {
+		t.Errorf("got devices %s, want X57", got)
+	}
+	if !strings.Contains(logs.String(), `"level":"WARN","msg":"Couldn't create device exporter","sn":"X58"`) {
+		t.Errorf("no warning for the conflicting device:\n%s", logs)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricNames records the name of every desc of an exporter as it is built,
+// descs have no getter for it
+type metricNames map[*prometheus.Desc]string
+
+func (names metricNames) gauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	gauge := prometheus.NewGauge(opts)
+	names[gauge.Desc()] = prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	return gauge
+}
+
+func (names metricNames) counter(opts prometheus.CounterOpts) prometheus.Counter {
+	counter := prometheus.NewCounter(opts)
+	names[counter.Desc()] = prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	return counter
+}
+
+func (names metricNames) desc(fqName string, help string, variableLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	desc := prometheus.NewDesc(fqName, help, variableLabels, constLabels)
+	names[desc] = fqName
+	return desc
+}
+
+// disabledDescs looks up the descs of the metrics named in disabledMetrics, an
+// unknown name is an error
+func (ecoflow *EcoflowExporter) disabledDescs(names []string) (map[*prometheus.Desc]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	byName := make(map[string]*prometheus.Desc, len(ecoflow.names))
+	for desc, name := range ecoflow.names {
+		byName[name] = desc
+	}
+
+	disabled := make(map[*prometheus.Desc]bool, len(names))
+	for _, name := range names {
+		desc, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric %q in disabledMetrics of %s", name, ecoflow.ecoflow.SerialNumber)
+		}
+		disabled[desc] = true
+	}
+	return disabled, nil
+}
+
+// filterMetrics returns a channel passing the metrics on to ch except the
+// disabled ones, and the function to call once all metrics are sent
+func filterMetrics(ch chan<- prometheus.Metric, disabled map[*prometheus.Desc]bool) (chan<- prometheus.Metric, func()) {
+	if len(disabled) == 0 {
+		return ch, func() {}
+	}
+
+	filtered := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for metric := range filtered {
+			if !disabled[metric.Desc()] {
+				ch <- metric
+			}
+		}
+	}()
+	return filtered, func() {
+		close(filtered)
+		<-done
+	}
+}
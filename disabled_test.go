@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDisabledMetrics(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X11", `{"code":"0","message":"Success","data":{"soc":50,"wattsInSum":10,"inv.inputWatts":10}}`)
+
+	// names are accepted with and without the namespace
+	device := api.device("X11")
+	device.DisabledMetrics = []string{"watts_in_sum", "ecoflow_watts_in"}
+	if err := device.defaults(nil); err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := CreateExporters(device, api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP ecoflow_soc State of charge
+# TYPE ecoflow_soc gauge
+ecoflow_soc{description="X11",sn="X11"} 50
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_soc", "ecoflow_watts_in_sum", "ecoflow_watts_in"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDisabledMetricsTypo(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	device := api.device("X12")
+	device.DisabledMetrics = []string{"ecoflow_wats_in_sum"}
+
+	_, err := CreateExporters(device, api.options())
+	if err == nil || !strings.Contains(err.Error(), `unknown metric "ecoflow_wats_in_sum"`) {
+		t.Errorf("got error %v, want the unknown metric", err)
+	}
+}
+
+func TestDisabledMetricsNames(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	device := api.device("X13")
+	device.Metrics = []string{"inv.acInVol"}
+	device.PostProcessors = []string{"efficiency"}
+	device.DisabledMetrics = []string{"ecoflow_quota_inv_acInVol", "ecoflow_efficiency", "ecoflow_soc_max"}
+	exporter, err := CreateExporters(device, api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exporter.disabled) != 3 {
+		t.Errorf("got %d disabled metrics, want 3", len(exporter.disabled))
+	}
+
+	// every metric can be disabled by name
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		exporter.describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		if exporter.names[desc] == "" {
+			t.Errorf("no name recorded for %s", desc)
+		}
+	}
+}
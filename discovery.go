@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// EcoflowDeviceList is the response of the device list API
+type EcoflowDeviceList struct {
+	Code    responseCode
+	Message string
+	Data    []EcoflowListedDevice
+}
+
+type EcoflowListedDevice struct {
+	SerialNumber string `json:"sn"`
+	DeviceName   string `json:"deviceName"`
+	Online       int    `json:"online"`
+}
+
+// decodeEcoflowDeviceList decodes a device list response body
+func decodeEcoflowDeviceList(body []byte) (EcoflowDeviceList, error) {
+	var list EcoflowDeviceList
+	err := json.Unmarshal(body, &list)
+	return list, err
+}
+
+// getEcoflowDeviceList lists the devices of the account the keys belong to
+func getEcoflowDeviceList(account *Ecoflow, options ExporterOptions) (EcoflowDeviceList, error) {
+	body, err := getEcoflowBody(options.DeviceListUrl.String(), false, account, options)
+	if err != nil {
+		return EcoflowDeviceList{}, err
+	}
+	return decodeEcoflowDeviceList(body)
+}
+
+// entryName names a config entry by index and description
+func entryName(i int, entry Ecoflow) string {
+	if entry.Description != "" {
+		return fmt.Sprintf("device %d (%s)", i, entry.Description)
+	}
+	return fmt.Sprintf("device %d", i)
+}
+
+// discoverDevices replaces the entries without serialNumber by the devices
+// listed for their keys. Every discovered device inherits the settings of its
+// entry and is described by its device name. Devices configured explicitly win,
+// they only take the online flag of the list.
+// The device lists are requested concurrently, at most
+// options.DiscoveryConcurrency at a time. A failed entry doesn't stop the
+// others, the devices found are returned together with the failures.
+func discoverDevices(devices []Ecoflow, options ExporterOptions) ([]Ecoflow, error) {
+	var result []Ecoflow
+	known := make(map[string]int)
+	for _, device := range devices {
+		if device.SerialNumber != "" {
+			known[device.SerialNumber] = len(result)
+			result = append(result, device)
+		}
+	}
+
+	lists := make([]EcoflowDeviceList, len(devices))
+	failures := make([]error, len(devices))
+	var group errgroup.Group
+	if options.DiscoveryConcurrency > 0 {
+		group.SetLimit(options.DiscoveryConcurrency)
+	}
+	for i, entry := range devices {
+		if entry.SerialNumber != "" {
+			continue
+		}
+		i, entry := i, entry
+		group.Go(func() error {
+			list, err := getEcoflowDeviceList(&entry, entry.exporterOptions(options))
+			if err == nil && "0" != list.Code {
+				err = fmt.Errorf("code %s, %s", list.Code, list.Message)
+			}
+			lists[i], failures[i] = list, err
+			// the other entries go on
+			return nil
+		})
+	}
+	group.Wait()
+
+	// the results are merged in config order, so the first entry listing a
+	// device wins as before
+	var errs []error
+	for i, entry := range devices {
+		if entry.SerialNumber != "" {
+			continue
+		}
+		if failures[i] != nil {
+			slog.Warn("Couldn't discover devices", "entry", entryName(i, entry), "error", failures[i])
+			errs = append(errs, fmt.Errorf("couldn't discover the devices of %s: %w", entryName(i, entry), failures[i]))
+			continue
+		}
+
+		discovered := 0
+		for _, listed := range lists[i].Data {
+			if listed.SerialNumber == "" {
+				continue
+			}
+			online := listed.Online != 0
+			if index, ok := known[listed.SerialNumber]; ok {
+				if result[index].Online == nil {
+					result[index].Online = &online
+				}
+				continue
+			}
+			device := entry
+			device.SerialNumber = listed.SerialNumber
+			device.Description = listed.DeviceName
+			if device.Description == "" {
+				device.Description = listed.SerialNumber
+			}
+			device.Online = &online
+			known[device.SerialNumber] = len(result)
+			result = append(result, device)
+			discovered++
+		}
+		slog.Info("Discovered devices", "entry", entryName(i, entry), "devices", discovered)
+	}
+	return result, errors.Join(errs...)
+}
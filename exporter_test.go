@@ -0,0 +1,813 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExporterCollect(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X1", `{"code":"0","message":"Success","data":{"soc":85,"wattsInSum":100,"wattsOutSum":40}}`)
+
+	exporter, err := CreateExporters(api.device("X1"), api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP ecoflow_soc State of charge
+# TYPE ecoflow_soc gauge
+ecoflow_soc{description="X1",sn="X1"} 85
+# HELP ecoflow_up Whether the last scrape of the device was successful
+# TYPE ecoflow_up gauge
+ecoflow_up{description="X1",sn="X1"} 1
+# HELP ecoflow_watts_in_sum Current wats input
+# TYPE ecoflow_watts_in_sum gauge
+ecoflow_watts_in_sum{description="X1",sn="X1"} 100
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_soc", "ecoflow_up", "ecoflow_watts_in_sum"); err != nil {
+		t.Error(err)
+	}
+	if count := api.requestCount("X1"); count != 1 {
+		t.Errorf("got %d quota requests, want 1", count)
+	}
+}
+
+func TestExporterWrongKeys(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X1", `{"code":"0","message":"Success","data":{"soc":85}}`)
+
+	device := api.device("X1")
+	device.SecretKey = "wrong"
+	exporter, err := CreateExporters(device, api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP ecoflow_api_code Code of the last API response, 0 is success, labeled with its message
+# TYPE ecoflow_api_code gauge
+ecoflow_api_code{description="X1",message="signature is wrong",sn="X1"} 8521
+# HELP ecoflow_up Whether the last scrape of the device was successful
+# TYPE ecoflow_up gauge
+ecoflow_up{description="X1",sn="X1"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_api_code", "ecoflow_up"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiscoverDevices(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setDevices(
+		EcoflowListedDevice{SerialNumber: "D1", DeviceName: "Garage"},
+		EcoflowListedDevice{SerialNumber: "D2"},
+		EcoflowListedDevice{SerialNumber: "X1", DeviceName: "Configured"},
+	)
+
+	entry := api.device("")
+	entry.Description = ""
+	devices, err := discoverDevices([]Ecoflow{api.device("X1"), entry}, api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, device := range devices {
+		got = append(got, device.SerialNumber+"="+device.Description)
+	}
+	// explicitly configured devices win, devices without name are described by sn
+	want := "X1=X1 D1=Garage D2=D2"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got %s, want %s", strings.Join(got, " "), want)
+	}
+}
+
+func TestMinScrapeInterval(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X3", `{"code":"0","message":"Success","data":{"soc":50}}`)
+
+	options := api.options()
+	options.MinScrapeInterval = time.Minute
+	exporter, err := CreateExporters(api.device("X3"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP ecoflow_soc State of charge
+# TYPE ecoflow_soc gauge
+ecoflow_soc{description="X3",sn="X3"} 50
+`
+	for i := 0; i < 2; i++ {
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_soc"); err != nil {
+			t.Error(err)
+		}
+	}
+	if count := api.requestCount("X3"); count != 1 {
+		t.Errorf("got %d quota requests, want 1", count)
+	}
+	if hits := testutil.ToFloat64(cacheHits.WithLabelValues("X3")); hits != 1 {
+		t.Errorf("got %v cache hits, want 1", hits)
+	}
+}
+
+func TestDeviceInfo(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X1", `{"code":"0","message":"Success","data":{"model":"DELTA 2","pd.sysVer":16908335}}`)
+	api.setQuota("X2", `{"code":"0","message":"Success","data":{"soc":10}}`)
+
+	expected := map[string]string{
+		"X1": `ecoflow_device{alias="garage",description="X1",firmware="1.2.0.47",link_group="home",model="DELTA 2",sn="X1"} 1`,
+		"X2": `ecoflow_device{alias="",description="X2",firmware="unknown",link_group="",model="unknown",sn="X2"} 1`,
+	}
+	for sn, want := range expected {
+		device := api.device(sn)
+		if sn == "X1" {
+			device.Alias, device.LinkGroup = "garage", "home"
+		}
+		exporter, err := CreateExporters(device, api.options())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = `
+# HELP ecoflow_device Device metadata, always 1, model and firmware are unknown until known from the API or config
+# TYPE ecoflow_device gauge
+` + want + "\n"
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "ecoflow_device"); err != nil {
+			t.Errorf("%s: %s", sn, err)
+		}
+	}
+}
+
+func TestScrapesTotal(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X4", `{"code":"0","message":"Success","data":{"soc":50}}`)
+
+	// cached scrapes count as well
+	options := api.options()
+	options.MinScrapeInterval = time.Minute
+	exporter, err := CreateExporters(api.device("X4"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.CollectAndCount(exporter)
+	expected := `
+# HELP ecoflow_scrapes_total Total number of collections of the device, including the ones served from cached values
+# TYPE ecoflow_scrapes_total counter
+ecoflow_scrapes_total{description="X4",sn="X4"} 2
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_scrapes_total"); err != nil {
+		t.Error(err)
+	}
+	if count := api.requestCount("X4"); count != 1 {
+		t.Errorf("got %d quota requests, want 1", count)
+	}
+}
+
+func TestDeviceOnline(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setDevices(
+		EcoflowListedDevice{SerialNumber: "D5", Online: 0},
+		EcoflowListedDevice{SerialNumber: "X5", Online: 1},
+	)
+	api.setQuota("D5", `{"code":"0","message":"Success","data":{"soc":40,"wattsInSum":10}}`)
+	api.setQuota("X5", `{"code":"0","message":"Success","data":{"soc":60,"wattsInSum":20}}`)
+	// the quota flag wins over the device list
+	api.setQuota("X6", `{"code":"0","message":"Success","data":{"soc":70,"online":0}}`)
+
+	entry := api.device("")
+	entry.Description = ""
+	devices, err := discoverDevices([]Ecoflow{api.device("X5"), api.device("X6"), entry}, api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"D5": `
+# HELP ecoflow_device_online Whether the device list or the quota data reports the device online, soc, remain_time and the watts sums are NaN while it is offline
+# TYPE ecoflow_device_online gauge
+ecoflow_device_online{description="D5",sn="D5"} 0
+# HELP ecoflow_soc State of charge
+# TYPE ecoflow_soc gauge
+ecoflow_soc{description="D5",sn="D5"} NaN
+# HELP ecoflow_watts_in_sum Current wats input
+# TYPE ecoflow_watts_in_sum gauge
+ecoflow_watts_in_sum{description="D5",sn="D5"} NaN
+`,
+		"X5": `
+# HELP ecoflow_device_online Whether the device list or the quota data reports the device online, soc, remain_time and the watts sums are NaN while it is offline
+# TYPE ecoflow_device_online gauge
+ecoflow_device_online{description="X5",sn="X5"} 1
+# HELP ecoflow_soc State of charge
+# TYPE ecoflow_soc gauge
+ecoflow_soc{description="X5",sn="X5"} 60
+# HELP ecoflow_watts_in_sum Current wats input
+# TYPE ecoflow_watts_in_sum gauge
+ecoflow_watts_in_sum{description="X5",sn="X5"} 20
+`,
+		"X6": `
+# HELP ecoflow_device_online Whether the device list or the quota data reports the device online, soc, remain_time and the watts sums are NaN while it is offline
+# TYPE ecoflow_device_online gauge
+ecoflow_device_online{description="X6",sn="X6"} 0
+# HELP ecoflow_soc State of charge
+# TYPE ecoflow_soc gauge
+ecoflow_soc{description="X6",sn="X6"} NaN
+# HELP ecoflow_watts_in_sum Current wats input
+# TYPE ecoflow_watts_in_sum gauge
+ecoflow_watts_in_sum{description="X6",sn="X6"} NaN
+`,
+	}
+	if len(devices) != len(expected) {
+		t.Fatalf("got %d devices, want %d", len(devices), len(expected))
+	}
+	for _, device := range devices {
+		exporter, err := CreateExporters(device, api.options())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := expected[device.SerialNumber]
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "ecoflow_device_online", "ecoflow_soc", "ecoflow_watts_in_sum"); err != nil {
+			t.Errorf("%s: %s", device.SerialNumber, err)
+		}
+	}
+}
+
+func TestAuthFailure(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X7", `{"code":"0","message":"Success","data":{"soc":50}}`)
+
+	device := api.device("X7")
+	device.SecretKey = "wrong"
+	exporter, err := CreateExporters(device, api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CollectAndCount(exporter)
+	if exporter.authSince.IsZero() {
+		t.Fatal("code 8521 didn't start the auth failure")
+	}
+	since := exporter.authSince
+
+	// the onset is kept while the credentials keep failing
+	testutil.CollectAndCount(exporter)
+	if !exporter.authSince.Equal(since) {
+		t.Errorf("auth failure restarted at %s, want %s", exporter.authSince, since)
+	}
+
+	exporter.ecoflow.SecretKey = "secret"
+	expected := `
+# HELP ecoflow_auth_failure_seconds Seconds since the API started rejecting the credentials with HTTP 401/403 or the codes 8513 (invalid appKey) and 8521 (wrong signature), 0 when accepted
+# TYPE ecoflow_auth_failure_seconds gauge
+ecoflow_auth_failure_seconds{description="X7",sn="X7"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_auth_failure_seconds"); err != nil {
+		t.Error(err)
+	}
+	if !exporter.authSince.IsZero() {
+		t.Error("accepted credentials didn't clear the auth failure")
+	}
+}
+
+func TestDataStaleness(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X8", `{"code":"0","message":"Success","data":{"soc":50}}`)
+
+	clock := newFakeClock()
+	options := api.options()
+	options.Now = clock.Now
+	good, err := CreateExporters(api.device("X8"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// X9 has no quota and fails from the start
+	failing, err := CreateExporters(api.device("X9"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staleness := func(exporter *EcoflowExporter) float64 {
+		testutil.CollectAndCount(exporter)
+		exporter.mutex.RLock()
+		defer exporter.mutex.RUnlock()
+		return testutil.ToFloat64(exporter.staleness)
+	}
+	if got := staleness(good); got != 0 {
+		t.Errorf("got staleness %v right after a successful scrape, want 0", got)
+	}
+
+	// with --poll-interval the values are only collected, not polled
+	good.options.PollInterval = time.Hour
+	clock.advance(90 * time.Second)
+	if got := staleness(good); got != 90 {
+		t.Errorf("got staleness %v, want 90", got)
+	}
+	clock.advance(60 * time.Second)
+	if got := staleness(good); got != 150 {
+		t.Errorf("got staleness %v, want 150", got)
+	}
+
+	if got := staleness(failing); got != 150 {
+		t.Errorf("got staleness %v of a device failing since startup, want 150", got)
+	}
+}
+
+func TestStaleOnError(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	for _, staleOnError := range []bool{true, false} {
+		api.setQuota("X10", `{"code":"0","message":"Success","data":{"soc":80,"remainTime":120,"wattsInSum":10,"wattsOutSum":30}}`)
+		options := api.options()
+		options.StaleOnError = staleOnError
+		exporter, err := CreateExporters(api.device("X10"), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.CollectAndCount(exporter)
+
+		api.setQuota("X10", `{"code":"1000","message":"server busy"}`)
+		values := "80 120 10 30"
+		if staleOnError {
+			values = "NaN NaN NaN NaN"
+		}
+		value := strings.Fields(values)
+		expected := `
+# HELP ecoflow_remain_time Remain time
+# TYPE ecoflow_remain_time gauge
+ecoflow_remain_time{description="X10",sn="X10"} ` + value[1] + `
+# HELP ecoflow_soc State of charge
+# TYPE ecoflow_soc gauge
+ecoflow_soc{description="X10",sn="X10"} ` + value[0] + `
+# HELP ecoflow_watts_in_sum Current wats input
+# TYPE ecoflow_watts_in_sum gauge
+ecoflow_watts_in_sum{description="X10",sn="X10"} ` + value[2] + `
+# HELP ecoflow_watts_out_sum Current wats output
+# TYPE ecoflow_watts_out_sum gauge
+ecoflow_watts_out_sum{description="X10",sn="X10"} ` + value[3] + `
+`
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_soc", "ecoflow_remain_time", "ecoflow_watts_in_sum", "ecoflow_watts_out_sum"); err != nil {
+			t.Errorf("stale on error %v: %s", staleOnError, err)
+		}
+	}
+}
+
+func TestApiCodeDeviceNotFound(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	exporter, err := CreateExporters(api.device("X14"), api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP ecoflow_api_code Code of the last API response, 0 is success, labeled with its message
+# TYPE ecoflow_api_code gauge
+ecoflow_api_code{description="X14",message="device not found",sn="X14"} 6042
+# HELP ecoflow_up Whether the last scrape of the device was successful
+# TYPE ecoflow_up gauge
+ecoflow_up{description="X14",sn="X14"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_api_code", "ecoflow_up"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X16", `{"code":"0","message":"Success","data":{"soc":50}}`)
+
+	clock := newFakeClock()
+	options := api.options()
+	options.Now = clock.Now
+	exporter, err := CreateExporters(api.device("X16"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a good scrape before the API limits the requests
+	testutil.CollectAndCount(exporter)
+	api.fail("X16", 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"120"}})
+
+	rateLimited := func(want float64) {
+		t.Helper()
+		expected := fmt.Sprintf(`
+# HELP ecoflow_rate_limited Whether polls of the device are suspended after a 429 response of the API
+# TYPE ecoflow_rate_limited gauge
+ecoflow_rate_limited{description="X16",sn="X16"} %v
+`, want)
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_rate_limited"); err != nil {
+			t.Error(err)
+		}
+		// the last good values are reported, --stale-on-error doesn't apply
+		if soc := testutil.ToFloat64(exporter.soc); soc != 50 {
+			t.Errorf("got soc %v while rate limited, want the last good 50", soc)
+		}
+	}
+	rateLimited(1)
+	// polls are suspended for the Retry-After
+	waits := testutil.ToFloat64(rateLimitWaits.WithLabelValues("retry_after"))
+	clock.advance(time.Minute)
+	rateLimited(1)
+	if got := testutil.ToFloat64(rateLimitWaits.WithLabelValues("retry_after")) - waits; got != 1 {
+		t.Errorf("got %v retry_after waits for the suppressed scrape, want 1", got)
+	}
+	if count := api.requestCount("X16"); count != 2 {
+		t.Errorf("got %d requests while rate limited, want 2", count)
+	}
+
+	clock.advance(time.Minute)
+	rateLimited(0)
+	if count := api.requestCount("X16"); count != 3 {
+		t.Errorf("got %d requests after the Retry-After, want 3", count)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"30", 30 * time.Second},
+		{"0", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"", defaultRetryAfter},
+		{"-5", defaultRetryAfter},
+		{"soon", defaultRetryAfter},
+	} {
+		if got := parseRetryAfter(test.value, now); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestScrapeDuration(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X25", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.setDelay(100 * time.Millisecond)
+
+	options := api.options()
+	options.CheckTimeout = time.Second
+	exporter, err := CreateExporters(api.device("X25"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CollectAndCount(exporter)
+	if duration := testutil.ToFloat64(exporter.duration); duration < 0.1 || duration >= 1 {
+		t.Errorf("got scrape duration %v, want between 0.1 and 1", duration)
+	}
+	if up := testutil.ToFloat64(exporter.up); up != 1 {
+		t.Errorf("got up %v, want 1", up)
+	}
+
+	// the server sleeps past the check timeout
+	options.CheckTimeout = 50 * time.Millisecond
+	exporter, err = CreateExporters(api.device("X25"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CollectAndCount(exporter)
+	if duration := testutil.ToFloat64(exporter.duration); duration < 0.05 || duration >= 0.1 {
+		t.Errorf("got scrape duration %v after a timeout, want between 0.05 and 0.1", duration)
+	}
+	if up := testutil.ToFloat64(exporter.up); up != 0 {
+		t.Errorf("got up %v after a timeout, want 0", up)
+	}
+}
+
+func TestDeviceCheckTimeout(t *testing.T) {
+	var config Config
+	if err := config.load([]byte("- serialNumber: X27\n  checkTimeout: 15s\n- serialNumber: X28\n")); err != nil {
+		t.Fatal(err)
+	}
+	global := ExporterOptions{CheckTimeout: 5 * time.Second}
+	if timeout := config.Devices[0].exporterOptions(global).CheckTimeout; timeout != 15*time.Second {
+		t.Errorf("got check timeout %s for the device with checkTimeout, want 15s", timeout)
+	}
+	if timeout := config.Devices[1].exporterOptions(global).CheckTimeout; timeout != 5*time.Second {
+		t.Errorf("got check timeout %s for the device without checkTimeout, want the global 5s", timeout)
+	}
+
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X27", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.setDelay(100 * time.Millisecond)
+	for _, test := range []struct {
+		global, device time.Duration
+		up             float64
+	}{
+		{50 * time.Millisecond, time.Second, 1},
+		{time.Second, 50 * time.Millisecond, 0},
+	} {
+		options := api.options()
+		options.CheckTimeout = test.global
+		device := api.device("X27")
+		device.CheckTimeout = test.device
+		exporter, err := CreateExporters(device, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.CollectAndCount(exporter)
+		if up := testutil.ToFloat64(exporter.up); up != test.up {
+			t.Errorf("global timeout %s, device timeout %s: got up %v, want %v", test.global, test.device, up, test.up)
+		}
+	}
+}
+
+func TestScrapeLogs(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X29", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	logs := captureLogs(t, slog.LevelDebug)
+
+	exporter, err := CreateExporters(api.device("X29"), api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CollectAndCount(exporter)
+	if !strings.Contains(logs.String(), `"level":"DEBUG","msg":"Device scraped","sn":"X29"`) {
+		t.Errorf("no debug log with the sn of the scraped device:\n%s", logs)
+	}
+
+	// failures are warnings
+	logs.Reset()
+	exporter, err = CreateExporters(api.device("X30"), api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CollectAndCount(exporter)
+	if !strings.Contains(logs.String(), `"level":"WARN","msg":"Device scrape failed","sn":"X30"`) {
+		t.Errorf("no warning with the sn of the failed device:\n%s", logs)
+	}
+}
+
+func TestDeviceLabels(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X50", `{"code":"0","message":"Success","data":{"soc":50,"wattsInSum":100,"wattsOutSum":40,"inv.inputWatts":100,"bmsMaster.temp":25}}`)
+	device := api.device("X50")
+	device.Labels = map[string]string{"room": "garage", "site": "home"}
+
+	exporter, err := CreateExporters(device, api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(exporter)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) < 10 {
+		t.Fatalf("got only %d metric families", len(families))
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["room"] != "garage" || labels["site"] != "home" {
+				t.Errorf("%s is missing the device labels: %v", family.GetName(), labels)
+			}
+		}
+	}
+
+	for _, name := range []string{"sn", "description"} {
+		device.Labels = map[string]string{name: "other"}
+		if err := validateConfig([]Ecoflow{device}); err == nil {
+			t.Errorf("device label %s was accepted", name)
+		}
+	}
+}
+
+func TestDiscoverDevicesFailingAccount(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setDevices(EcoflowListedDevice{SerialNumber: "D10"})
+	api.addAccount("office", "office-secret", EcoflowListedDevice{SerialNumber: "D11"}, EcoflowListedDevice{SerialNumber: "D12"})
+
+	entries := []Ecoflow{
+		{AppKey: "key", SecretKey: "secret"},
+		{AppKey: "cabin", SecretKey: "wrong", Description: "cabin"},
+		{AppKey: "office", SecretKey: "office-secret"},
+	}
+	options := api.options()
+	options.DiscoveryConcurrency = 2
+	devices, err := discoverDevices(entries, options)
+
+	// the devices of the other accounts are still found
+	var got []string
+	for _, device := range devices {
+		got = append(got, device.SerialNumber+"/"+device.AppKey)
+	}
+	if want := "D10/key D11/office D12/office"; strings.Join(got, " ") != want {
+		t.Errorf("got %s, want %s", strings.Join(got, " "), want)
+	}
+	want := "couldn't discover the devices of device 1 (cabin): code 8521, signature is wrong"
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestMetricNamespace(t *testing.T) {
+	defer func(previous string) { namespace = previous }(namespace)
+	namespace = "home"
+
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X56", `{"code":"0","message":"Success","data":{"soc":50,"wattsInSum":100,"inv.inputWatts":100,"bmsMaster.temp":25}}`)
+	device := api.device("X56")
+	device.Metrics = []string{"inv.inputWatts"}
+	exporter, err := CreateExporters(device, api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(exporter)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) == 0 {
+		t.Fatal("no metrics")
+	}
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "home_") {
+			t.Errorf("metric %s doesn't start with the namespace", family.GetName())
+		}
+	}
+}
+
+func TestPollJitter(t *testing.T) {
+	const jitter = 500 * time.Millisecond
+	for _, sn := range []string{"X59", "X60"} {
+		offset := pollOffset(sn, jitter, 42)
+		if offset < 0 || offset >= jitter {
+			t.Errorf("%s: got offset %s, want below %s", sn, offset, jitter)
+		}
+		if again := pollOffset(sn, jitter, 42); again != offset {
+			t.Errorf("%s: got offsets %s and %s for the same seed", sn, offset, again)
+		}
+	}
+	if offset := pollOffset("X59", 0, 42); offset != 0 {
+		t.Errorf("got offset %s without jitter, want 0", offset)
+	}
+
+	// the first polls are spread by the offsets
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X59", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.setQuota("X60", `{"code":"0","message":"Success","data":{"soc":60}}`)
+	options := api.options()
+	options.PollInterval = time.Hour
+	options.PollJitter = jitter
+	options.PollJitterSeed = 42
+	start := time.Now()
+	newTestSet(t, []Ecoflow{api.device("X59"), api.device("X60")}, options)
+
+	for deadline := start.Add(2 * jitter); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if !api.firstRequest("X59").IsZero() && !api.firstRequest("X60").IsZero() {
+			break
+		}
+	}
+	for _, sn := range []string{"X59", "X60"} {
+		first := api.firstRequest(sn)
+		if first.IsZero() {
+			t.Fatalf("%s wasn't polled", sn)
+		}
+		// the poll itself may take a little while
+		offset := pollOffset(sn, jitter, 42)
+		if delay := first.Sub(start); delay < offset || delay > offset+100*time.Millisecond {
+			t.Errorf("%s: first poll after %s, want about %s", sn, delay, offset)
+		}
+	}
+}
+
+func TestTelemetryStale(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	options := api.options()
+	options.StaleTelemetryPolls = 3
+	exporter, err := CreateExporters(api.device("X67"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, step := range []struct {
+		soc   string
+		stale float64
+	}{
+		{"50", 0},
+		{"50", 0},
+		// the third identical response in a row
+		{"50", 1},
+		{"50", 1},
+		{"49", 0},
+		{"49", 0},
+		{"49", 1},
+	} {
+		api.setQuota("X67", `{"code":"0","message":"Success","data":{"soc":`+step.soc+`}}`)
+		testutil.CollectAndCount(exporter)
+		if stale := testutil.ToFloat64(exporter.stale); stale != step.stale {
+			t.Errorf("poll %d: got telemetry_stale %v, want %v", i+1, stale, step.stale)
+		}
+	}
+}
+
+func TestQuotaMetricTypes(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	device := api.device("X76")
+	device.Metrics = []string{"inv.acInVol", "pd.chgPowerAc", "pd.dsgPowerAc"}
+	device.MetricTypes = map[string]string{"pd.dsgPowerAc": "gauge"}
+	exporter, err := CreateExporters(device, api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the device resets its totals between the second and third poll
+	for _, step := range []struct {
+		device, counter string
+	}{
+		{"100", "100"},
+		{"250", "250"},
+		{"20", "270"},
+	} {
+		api.setQuota("X76", `{"code":"0","message":"Success","data":{"inv.acInVol":230000,"pd.chgPowerAc":`+step.device+`,"pd.dsgPowerAc":`+step.device+`}}`)
+		expected := `
+# HELP ecoflow_quota_inv_acInVol Quota field inv.acInVol
+# TYPE ecoflow_quota_inv_acInVol gauge
+ecoflow_quota_inv_acInVol{description="X76",sn="X76"} 230000
+# HELP ecoflow_quota_pd_chgPowerAc_total Quota field pd.chgPowerAc
+# TYPE ecoflow_quota_pd_chgPowerAc_total counter
+ecoflow_quota_pd_chgPowerAc_total{description="X76",sn="X76"} ` + step.counter + `
+# HELP ecoflow_quota_pd_dsgPowerAc Quota field pd.dsgPowerAc
+# TYPE ecoflow_quota_pd_dsgPowerAc gauge
+ecoflow_quota_pd_dsgPowerAc{description="X76",sn="X76"} ` + step.device + "\n"
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_quota_inv_acInVol", "ecoflow_quota_pd_chgPowerAc_total", "ecoflow_quota_pd_dsgPowerAc"); err != nil {
+			t.Errorf("device total %s: %s", step.device, err)
+		}
+	}
+}
+
+func TestDeviceUpdating(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	for _, staleWhileUpdating := range []bool{true, false} {
+		options := api.options()
+		options.StaleWhileUpdating = staleWhileUpdating
+		exporter, err := CreateExporters(api.device("X79"), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range []struct {
+			otaStatus, updating, soc string
+		}{
+			{"1", "1", "80"},
+			{"0", "0", "80"},
+		} {
+			api.setQuota("X79", `{"code":"0","message":"Success","data":{"soc":80,"pd.otaStatus":`+step.otaStatus+`}}`)
+			soc := step.soc
+			if staleWhileUpdating && step.updating == "1" {
+				soc = "NaN"
+			}
+			expected := `
+# HELP ecoflow_device_updating Device installs a firmware update and its telemetry is unreliable, 0 if the device doesn't report it
+# TYPE ecoflow_device_updating gauge
+ecoflow_device_updating{description="X79",sn="X79"} ` + step.updating + `
+# HELP ecoflow_soc State of charge
+# TYPE ecoflow_soc gauge
+ecoflow_soc{description="X79",sn="X79"} ` + soc + "\n"
+			if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_device_updating", "ecoflow_soc"); err != nil {
+				t.Errorf("stale while updating %v, otaStatus %s: %s", staleWhileUpdating, step.otaStatus, err)
+			}
+		}
+	}
+}
+
+func TestSocChangePerMinute(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("S1", `{"code":"0","message":"Success","data":{"soc":50}}`)
+
+	clock := newFakeClock()
+	options := api.options()
+	options.Now = clock.Now
+	exporter, err := CreateExporters(api.device("S1"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socChange := func() float64 {
+		testutil.CollectAndCount(exporter)
+		exporter.mutex.RLock()
+		defer exporter.mutex.RUnlock()
+		return testutil.ToFloat64(exporter.socChange)
+	}
+
+	// there is no rate before the second scrape
+	if got := socChange(); !math.IsNaN(got) {
+		t.Errorf("got change %v after the first scrape, want NaN", got)
+	}
+	api.setQuota("S1", `{"code":"0","message":"Success","data":{"soc":44}}`)
+	clock.advance(2 * time.Minute)
+	if got := socChange(); got != -3 {
+		t.Errorf("got change %v after losing 6%% in 2 minutes, want -3", got)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// extremes tracks the lowest and highest value observed since startup. Nothing
+// is reported before the first value.
+type extremes struct {
+	min     prometheus.Gauge
+	max     prometheus.Gauge
+	lowest  float64
+	highest float64
+	seen    bool
+}
+
+func newExtremes(named metricNames, name string, help string, labels prometheus.Labels) *extremes {
+	return &extremes{
+		min: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        name + "_min",
+			Help:        "Lowest " + help + " since startup",
+			ConstLabels: labels,
+		}),
+		max: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        name + "_max",
+			Help:        "Highest " + help + " since startup",
+			ConstLabels: labels,
+		}),
+	}
+}
+
+func (e *extremes) update(value float64) {
+	if !e.seen || value < e.lowest {
+		e.lowest = value
+		e.min.Set(value)
+	}
+	if !e.seen || value > e.highest {
+		e.highest = value
+		e.max.Set(value)
+	}
+	e.seen = true
+}
+
+func (e *extremes) describe(ch chan<- *prometheus.Desc) {
+	ch <- e.min.Desc()
+	ch <- e.max.Desc()
+}
+
+func (e *extremes) collect(ch chan<- prometheus.Metric) {
+	if !e.seen {
+		return
+	}
+	ch <- e.min
+	ch <- e.max
+}
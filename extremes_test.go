@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// extremesCollector exposes extremes on their own for testutil
+type extremesCollector struct{ *extremes }
+
+func (c extremesCollector) Describe(ch chan<- *prometheus.Desc) { c.describe(ch) }
+func (c extremesCollector) Collect(ch chan<- prometheus.Metric) { c.collect(ch) }
+
+func TestExtremes(t *testing.T) {
+	labels := prometheus.Labels{"sn": "E1"}
+	e := newExtremes(metricNames{}, "soc", "state of charge", labels)
+	if got := testutil.CollectAndCount(extremesCollector{e}); got != 0 {
+		t.Errorf("got %d metrics before the first value, want none", got)
+	}
+
+	for i, step := range []struct {
+		value    float64
+		min, max float64
+	}{
+		{50, 50, 50},
+		{40, 40, 50},
+		{45, 40, 50},
+		{80, 40, 80},
+		{0, 0, 80},
+	} {
+		e.update(step.value)
+		if min, max := testutil.ToFloat64(e.min), testutil.ToFloat64(e.max); min != step.min || max != step.max {
+			t.Errorf("step %d (%v): got min %v, max %v, want %v, %v", i, step.value, min, max, step.min, step.max)
+		}
+	}
+}
+
+func TestExtremesReset(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("E2", `{"code":"0","message":"Success","data":{"soc":30}}`)
+	exporter, err := CreateExporters(api.device("E2"), api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CollectAndCount(exporter)
+	api.setQuota("E2", `{"code":"0","message":"Success","data":{"soc":70}}`)
+	testutil.CollectAndCount(exporter)
+
+	expected := `
+# HELP ecoflow_soc_max Highest state of charge since startup
+# TYPE ecoflow_soc_max gauge
+ecoflow_soc_max{description="E2",sn="E2"} 70
+# HELP ecoflow_soc_min Lowest state of charge since startup
+# TYPE ecoflow_soc_min gauge
+ecoflow_soc_min{description="E2",sn="E2"} 30
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_soc_min", "ecoflow_soc_max"); err != nil {
+		t.Error(err)
+	}
+
+	// a restart starts over from the next value
+	restarted, err := CreateExporters(api.device("E2"), api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `
+# HELP ecoflow_soc_max Highest state of charge since startup
+# TYPE ecoflow_soc_max gauge
+ecoflow_soc_max{description="E2",sn="E2"} 70
+# HELP ecoflow_soc_min Lowest state of charge since startup
+# TYPE ecoflow_soc_min gauge
+ecoflow_soc_min{description="E2",sn="E2"} 70
+`
+	if err := testutil.CollectAndCompare(restarted, strings.NewReader(expected), "ecoflow_soc_min", "ecoflow_soc_max"); err != nil {
+		t.Error(err)
+	}
+}
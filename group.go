@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LinkGroupExporter collects the devices linked together with the same linkGroup
+// and reports their combined values once all members are scraped
+type LinkGroupExporter struct {
+	members  []*EcoflowExporter
+	socavg   prometheus.Gauge
+	wattsout prometheus.Gauge
+	wattsin  prometheus.Gauge
+}
+
+func CreateLinkGroupExporter(name string, members []*EcoflowExporter, commonLabels map[string]string) *LinkGroupExporter {
+	labels := prometheus.Labels{"link_group": name}
+	for label, value := range commonLabels {
+		labels[label] = value
+	}
+
+	return &LinkGroupExporter{
+		members: members,
+
+		socavg: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "group_soc_avg",
+			Help:        "Average state of charge of the link group devices",
+			ConstLabels: labels,
+		}),
+
+		wattsout: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "group_watts_out",
+			Help:        "Combined watts output of the link group devices",
+			ConstLabels: labels,
+		}),
+
+		wattsin: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "group_watts_in",
+			Help:        "Combined watts input of the link group devices",
+			ConstLabels: labels,
+		}),
+	}
+}
+
+func (group *LinkGroupExporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, member := range group.members {
+		member.Describe(ch)
+	}
+	ch <- group.socavg.Desc()
+	ch <- group.wattsout.Desc()
+	ch <- group.wattsin.Desc()
+}
+
+func (group *LinkGroupExporter) Collect(ch chan<- prometheus.Metric) {
+	group.scrape(context.Background(), ch)
+}
+
+// scrape collects the members with the context of the scrape request
+func (group *LinkGroupExporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	for _, member := range group.members {
+		wg.Add(1)
+		go func(member *EcoflowExporter) {
+			defer wg.Done()
+			// the members take their turns in the scrape order
+			defer passScrapeTurn(ctx, member.ecoflow.SerialNumber)
+			member.scrape(ctx, ch)
+		}(member)
+	}
+	wg.Wait()
+
+	// only members scraped successfully this time count
+	var soc, wattsout, wattsin float64
+	healthy := 0
+	for _, member := range group.members {
+		member.mutex.RLock()
+		if member.ok {
+			soc += member.data.Soc
+			wattsout += member.data.WattsOutSum
+			wattsin += member.data.WattsInSum
+			healthy++
+		}
+		member.mutex.RUnlock()
+	}
+	if healthy == 0 {
+		return
+	}
+
+	group.socavg.Set(soc / float64(healthy))
+	group.wattsout.Set(wattsout)
+	group.wattsin.Set(wattsin)
+	ch <- group.socavg
+	ch <- group.wattsout
+	ch <- group.wattsin
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// deviceHealth is the result of the last health check of a device
+type deviceHealth struct {
+	SerialNumber string    `json:"sn"`
+	Description  string    `json:"description"`
+	Reachable    bool      `json:"reachable"`
+	Code         string    `json:"code,omitempty"`
+	Message      string    `json:"message,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Checked      time.Time `json:"checked"`
+}
+
+// deviceHealthState is kept apart from the exporter mutex, so the health
+// endpoint never waits for a running scrape
+type deviceHealthState struct {
+	mutex  sync.RWMutex
+	health deviceHealth
+}
+
+// healthCheck checks the device every HealthInterval, independently of the
+// scrapes. The checks are skipped while the device is rate limited.
+func (ecoflow *EcoflowExporter) healthCheck(ctx context.Context) {
+	for {
+		ecoflow.mutex.RLock()
+		limited := ecoflow.limited()
+		ecoflow.mutex.RUnlock()
+
+		if !limited {
+			health := ecoflow.checkHealth(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			ecoflow.health.mutex.Lock()
+			ecoflow.health.health = health
+			ecoflow.health.mutex.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ecoflow.options.HealthInterval):
+		}
+	}
+}
+
+// checkHealth makes a single quota request limited by HealthTimeout. It takes
+// no --max-concurrent-scrapes slot, isn't retried and isn't part of the scrape
+// metrics; only a 429 response is passed on, so the polls back off as well.
+func (ecoflow *EcoflowExporter) checkHealth(ctx context.Context) deviceHealth {
+	health := deviceHealth{
+		SerialNumber: ecoflow.ecoflow.SerialNumber,
+		Description:  ecoflow.ecoflow.Description,
+		Checked:      time.Now(),
+	}
+
+	apiUrl := *ecoflow.options.ApiUrl
+	query := apiUrl.Query()
+	query.Set("sn", ecoflow.ecoflow.SerialNumber)
+	apiUrl.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, ecoflow.options.HealthTimeout)
+	defer cancel()
+
+	res, _, err := requestEcoflowApi(ctx, apiUrl.String(), ecoflow.ecoflow, ecoflow.options)
+	if res.StatusCode == http.StatusTooManyRequests {
+		ecoflow.mutex.Lock()
+		if until := ecoflow.options.Now().Add(res.RetryAfter); until.After(ecoflow.limitedUntil) {
+			ecoflow.limitedUntil = until
+		}
+		ecoflow.mutex.Unlock()
+	}
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	health.Code = string(res.Code)
+	health.Message = res.Message
+	health.Reachable = "0" == res.Code
+	return health
+}
+
+// healthHandler serves the last health check of every device as JSON, devices
+// not checked yet are left out
+func healthHandler(devices *exporterSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		devices.mutex.RLock()
+		results := make([]deviceHealth, 0, len(devices.exporters))
+		for _, exporter := range devices.exporters {
+			exporter.health.mutex.RLock()
+			if !exporter.health.health.Checked.IsZero() {
+				results = append(results, exporter.health.health)
+			}
+			exporter.health.mutex.RUnlock()
+		}
+		devices.mutex.RUnlock()
+
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].SerialNumber < results[j].SerialNumber
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}
+}
+
+// livenessHandler answers as long as the process serves HTTP, it never calls
+// the API
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK\n"))
+}
+
+// readinessHandler answers 200 once started is closed, i.e. the config is loaded
+// and the devices are registered
+func readinessHandler(started <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-started:
+			w.Write([]byte("OK\n"))
+		default:
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLivenessHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	livenessHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "OK\n" {
+		t.Errorf("got status %d and body %q, want 200 OK", rec.Code, rec.Body)
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	started := make(chan struct{})
+	handler := readinessHandler(started)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d while starting, want 503", rec.Code)
+	}
+
+	close(started)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d once started, want 200", rec.Code)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X64", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.fail("X66", 1, http.StatusBadGateway, nil)
+	options := api.options()
+	options.HealthInterval = time.Hour
+	options.HealthTimeout = time.Second
+	// X65 isn't known to the API
+	set := newTestSet(t, []Ecoflow{api.device("X64"), api.device("X65"), api.device("X66")}, options)
+
+	var results []deviceHealth
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rec := httptest.NewRecorder()
+		healthHandler(set).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz/devices", nil))
+		if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Fatalf("got Content-Type %s, want application/json", contentType)
+		}
+		results = nil
+		if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) == 3 {
+			break
+		}
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+
+	for i, want := range []deviceHealth{
+		{SerialNumber: "X64", Description: "X64", Reachable: true, Code: "0", Message: "Success"},
+		{SerialNumber: "X65", Description: "X65", Code: "6042", Message: "device not found"},
+		{SerialNumber: "X66", Description: "X66", Error: "unexpected HTTP status 502"},
+	} {
+		got := results[i]
+		if got.Checked.IsZero() {
+			t.Errorf("%s wasn't checked", want.SerialNumber)
+			continue
+		}
+		want.Checked = got.Checked
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestHealthHandlerUnchecked(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	exporter, err := CreateExporters(api.device("X67"), api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &exporterSet{exporters: map[string]*EcoflowExporter{"X67": exporter}}
+
+	rec := httptest.NewRecorder()
+	healthHandler(set).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz/devices", nil))
+	if body := strings.TrimSpace(rec.Body.String()); body != "[]" {
+		t.Errorf("got %s before the first check, want []", body)
+	}
+}
+
+func TestCheckHealthSingleRequest(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.fail("X68", 1, http.StatusBadGateway, nil)
+	options := api.options()
+	options.HealthTimeout = time.Second
+	options.MaxRetries = 3
+	// every slot is taken, the check doesn't wait for one
+	options.Semaphore = make(chan struct{}, 1)
+	options.Semaphore <- struct{}{}
+	exporter, err := CreateExporters(api.device("X68"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	health := exporter.checkHealth(context.Background())
+	if health.Reachable || health.Error != "unexpected HTTP status 502" {
+		t.Errorf("got %+v, want the 502", health)
+	}
+	if count := api.requestCount("X68"); count != 1 {
+		t.Errorf("got %d requests, want 1 without retries", count)
+	}
+	for _, outcome := range []string{"success", "api_error", "error"} {
+		if apiRequestDuration.DeleteLabelValues("X68", outcome) {
+			t.Errorf("the check is in api_request_duration_seconds with outcome %s", outcome)
+		}
+	}
+}
+
+func TestHealthCheckRateLimited(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.fail("X69", 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"120"}})
+	clock := newFakeClock()
+	options := api.options()
+	options.Now = clock.Now
+	options.HealthTimeout = time.Second
+	options.HealthInterval = 10 * time.Millisecond
+	exporter, err := CreateExporters(api.device("X69"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the 429 of the check suspends the polls and the further checks
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		exporter.healthCheck(ctx)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	if count := api.requestCount("X69"); count != 1 {
+		t.Errorf("got %d requests while rate limited, want 1", count)
+	}
+	exporter.mutex.RLock()
+	limited := exporter.limited()
+	exporter.mutex.RUnlock()
+	if !limited {
+		t.Error("the 429 of the check didn't suspend the polls")
+	}
+}
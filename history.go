@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// scrapeRecord is one entry of the scrape history
+type scrapeRecord struct {
+	Time        time.Time `json:"time"`
+	Ok          bool      `json:"ok"`
+	Error       string    `json:"error,omitempty"`
+	Soc         float64   `json:"soc"`
+	WattsInSum  float64   `json:"wattsInSum"`
+	WattsOutSum float64   `json:"wattsOutSum"`
+}
+
+// scrapeHistory is a fixed size ring buffer of the recent scrapes of a device
+type scrapeHistory struct {
+	mutex   sync.Mutex
+	records []scrapeRecord
+	next    int
+	full    bool
+}
+
+func newScrapeHistory(size int) *scrapeHistory {
+	return &scrapeHistory{records: make([]scrapeRecord, size)}
+}
+
+func (history *scrapeHistory) add(record scrapeRecord) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	history.records[history.next] = record
+	history.next = (history.next + 1) % len(history.records)
+	if history.next == 0 {
+		history.full = true
+	}
+}
+
+// list returns the records, oldest first
+func (history *scrapeHistory) list() []scrapeRecord {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	if !history.full {
+		return append([]scrapeRecord{}, history.records[:history.next]...)
+	}
+	return append(append([]scrapeRecord{}, history.records[history.next:]...), history.records[:history.next]...)
+}
+
+// historyHandler serves the scrape history of the device given by the sn query parameter
+func historyHandler(devices *exporterSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		exporter, ok := devices.get(r.URL.Query().Get("sn"))
+		if !ok {
+			http.Error(w, "unknown device", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(exporter.history.list())
+	}
+}
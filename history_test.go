@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScrapeHistory(t *testing.T) {
+	history := newScrapeHistory(3)
+	socs := func() []float64 {
+		var socs []float64
+		for _, record := range history.list() {
+			socs = append(socs, record.Soc)
+		}
+		return socs
+	}
+	equal := func(got, want []float64) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if got := socs(); len(got) != 0 {
+		t.Errorf("got %v from an empty history, want nothing", got)
+	}
+	for i, want := range [][]float64{
+		{1},
+		{1, 2},
+		// at capacity
+		{1, 2, 3},
+		// wraparound: the oldest records are dropped, oldest first stays
+		{2, 3, 4},
+		{3, 4, 5},
+		{4, 5, 6},
+		{5, 6, 7},
+	} {
+		history.add(scrapeRecord{Soc: float64(i + 1)})
+		if got := socs(); !equal(got, want) {
+			t.Errorf("after %d records got %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestScrapeHistoryHandler(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("H1", `{"code":"0","message":"Success","data":{"soc":50}}`)
+
+	clock := newFakeClock()
+	options := api.options()
+	options.Now = clock.Now
+	options.HistorySize = 2
+	set := newTestSet(t, []Ecoflow{api.device("H1")}, options)
+	exporter, _ := set.get("H1")
+
+	start := clock.Now()
+	for i := 0; i < 3; i++ {
+		if i == 1 {
+			api.fail("H1", 1, 500, nil)
+		}
+		clock.advance(time.Minute)
+		testutil.CollectAndCount(exporter)
+	}
+
+	rec := httptest.NewRecorder()
+	historyHandler(set)(rec, httptest.NewRequest("GET", "/debug/history?sn=H1", nil))
+	var records []scrapeRecord
+	if err := json.NewDecoder(rec.Body).Decode(&records); err != nil {
+		t.Fatal(err)
+	}
+	// the first scrape is dropped, the times come from the exporter clock
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2: %+v", len(records), records)
+	}
+	if records[0].Ok || !records[0].Time.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("got first record %+v, want the failure at %s", records[0], start.Add(2*time.Minute))
+	}
+	if !records[1].Ok || records[1].Soc != 50 || !records[1].Time.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("got second record %+v, want the success at %s", records[1], start.Add(3*time.Minute))
+	}
+}
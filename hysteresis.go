@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// errorHysteresis debounces check results so check_error does not flap: the error
+// is raised after up consecutive failures, cleared after down consecutive successes
+// and every change is kept for at least hold.
+type errorHysteresis struct {
+	up        int
+	down      int
+	hold      time.Duration
+	failing   bool
+	failures  int
+	successes int
+	changed   time.Time
+}
+
+// update records one check result and returns the debounced error state
+func (h *errorHysteresis) update(ok bool, now time.Time) bool {
+	if ok {
+		h.successes++
+		h.failures = 0
+	} else {
+		h.failures++
+		h.successes = 0
+	}
+
+	if now.Sub(h.changed) < h.hold {
+		return h.failing
+	}
+
+	if !h.failing && h.failures >= h.up {
+		h.failing = true
+		h.changed = now
+	} else if h.failing && h.successes >= h.down {
+		h.failing = false
+		h.changed = now
+	}
+	return h.failing
+}
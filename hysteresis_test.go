@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestErrorHysteresis(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := errorHysteresis{up: 2, down: 3, hold: time.Minute}
+
+	for i, step := range []struct {
+		ok      bool
+		elapsed time.Duration
+		want    bool
+	}{
+		// up: raised on the second failure in a row
+		{false, 0, false},
+		{true, time.Second, false},
+		{false, 2 * time.Minute, false},
+		{false, 3 * time.Minute, true},
+		// hold: successes within a minute of the change don't clear it
+		{true, 3*time.Minute + 10*time.Second, true},
+		{true, 3*time.Minute + 20*time.Second, true},
+		{true, 3*time.Minute + 30*time.Second, true},
+		// down: cleared after three successes in a row, once the hold is over
+		{true, 4 * time.Minute, false},
+		// hold: failures right after clearing don't raise it again
+		{false, 4*time.Minute + 10*time.Second, false},
+		{false, 4*time.Minute + 20*time.Second, false},
+		{false, 5 * time.Minute, true},
+	} {
+		if got := h.update(step.ok, start.Add(step.elapsed)); got != step.want {
+			t.Errorf("step %d (ok %v at %s): got failing %v, want %v", i, step.ok, step.elapsed, got, step.want)
+		}
+	}
+}
+
+func TestErrorHysteresisImmediate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// the defaults follow every result
+	h := errorHysteresis{up: 1, down: 1}
+	for i, ok := range []bool{true, false, true, false, false, true} {
+		if got := h.update(ok, now); got == ok {
+			t.Errorf("result %d: got failing %v for ok %v", i, got, ok)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+)
+
+// landingHandler serves a minimal page on / linking to the metrics, so opening
+// the exporter in a browser shows it is alive
+func landingHandler(metricsPath string) http.HandlerFunc {
+	page := fmt.Sprintf(`<html>
+<head><title>EcoFlow Exporter</title></head>
+<body>
+<h1>EcoFlow Exporter</h1>
+<p>Version %s</p>
+<p><a href="%s">Metrics</a></p>
+</body>
+</html>
+`, html.EscapeString(version), html.EscapeString(metricsPath))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// / matches every path without a handler of its own
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLandingHandler(t *testing.T) {
+	handler := landingHandler("/custom-metrics")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want 200", rec.Code)
+	}
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("got Content-Type %s, want text/html", contentType)
+	}
+	if !strings.Contains(rec.Body.String(), `<a href="/custom-metrics">`) {
+		t.Errorf("no link to the metrics path:\n%s", rec.Body)
+	}
+
+	// the page isn't served for every unknown path
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown path, want 404", rec.Code)
+	}
+}
@@ -1,46 +1,417 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 	"github.com/spf13/pflag"
-	"gopkg.in/yaml.v2"
+	"golang.org/x/net/http/httpproxy"
+	"hash/fnv"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
+// namespace prefixes all metric names, set by --metric-namespace
+var namespace = "ecoflow"
+
 const (
-	namespace = "ecoflow"
+	// defaultRetryAfter is the back off after a 429 response without a usable
+	// Retry-After
+	defaultRetryAfter = time.Minute
+)
+
+// the exporter wide metrics are created by initMetrics, once the namespace and
+// the buckets are known
+var (
+	concurrentScrapes    prometheus.Gauge
+	maxConcurrentScrapes prometheus.Gauge
+	apiRequestDuration   *prometheus.HistogramVec
+	scrapeSlotWait       *prometheus.HistogramVec
+	configDevices        *prometheus.GaugeVec
+	cacheHits            *prometheus.CounterVec
+	retriesSkipped       prometheus.Counter
+	rateLimitWaits       *prometheus.CounterVec
 )
 
+func initMetrics(buckets []float64) {
+	concurrentScrapes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "concurrent_scrapes",
+		Help:      "API requests currently in flight",
+	})
+
+	maxConcurrentScrapes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "max_concurrent_scrapes",
+		Help:      "Limit of API requests in flight, 0 is unlimited",
+	})
+
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of quota API requests including retries, by outcome: success, api_error (non-zero code) or error. The wait for a --max-concurrent-scrapes slot isn't included.",
+		Buckets:   buckets,
+	}, []string{"sn", "outcome"})
+
+	scrapeSlotWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scrape_slot_wait_seconds",
+		Help:      "Time quota API requests waited for a --max-concurrent-scrapes slot, not for an API rate limit",
+		Buckets:   buckets,
+	}, []string{"sn"})
+
+	configDevices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_devices_total",
+		Help:      "Configured devices by link group and model",
+	}, []string{"link_group", "model"})
+
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_hit_total",
+		Help:      "Scrapes served from the last result because of --min-scrape-interval",
+	}, []string{"sn"})
+
+	retriesSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_skipped_total",
+		Help:      "Retries not made because the --retry-budget was used up",
+	})
+
+	rateLimitWaits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_waits_total",
+		Help:      "Times the exporter held back API requests, by reason: slot (all --max-concurrent-scrapes slots taken) or retry_after (polls suspended after a 429 response)",
+	}, []string{"reason"})
+
+	buildInfo = newBuildInfo()
+}
+
 type Ecoflow struct {
-	Description  string `yaml:"description"`
-	SerialNumber string `yaml:"serialNumber"`
-	AppKey       string `yaml:"appKey"`
-	SecretKey    string `yaml:"secretKey"`
+	Description    string   `yaml:"description"`
+	SerialNumber   string   `yaml:"serialNumber"`
+	AppKey         string   `yaml:"appKey"`
+	SecretKey      string   `yaml:"secretKey"`
+	AppKeyFile     string   `yaml:"appKeyFile"`
+	SecretKeyFile  string   `yaml:"secretKeyFile"`
+	Account        string   `yaml:"account"`
+	Model          string   `yaml:"model"`
+	CapacityWh     float64  `yaml:"capacityWh"`
+	PreferConfig   bool     `yaml:"preferConfig"`
+	LinkGroup      string   `yaml:"linkGroup"`
+	Alias          string   `yaml:"alias"`
+	PostProcessors []string `yaml:"postProcessors"`
+	Metrics        []string `yaml:"metrics"`
+
+	// MetricTypes set counter or gauge for keys under metrics, known energy
+	// totals and battery cycles are counters otherwise
+	MetricTypes map[string]string `yaml:"metricTypes"`
+
+	// Priority orders the API requests of a scrape under
+	// --max-concurrent-scrapes, higher first, link group members included
+	Priority int `yaml:"priority"`
+
+	// CheckTimeout overrides --check-timeout for this device
+	CheckTimeout time.Duration `yaml:"checkTimeout"`
+	// AttemptTimeout and AttemptTimeoutMultiplier override --attempt-timeout
+	// and --attempt-timeout-multiplier for this device
+	AttemptTimeout           time.Duration `yaml:"attemptTimeout"`
+	AttemptTimeoutMultiplier float64       `yaml:"attemptTimeoutMultiplier"`
+
+	// Transport is http to poll the quota API, or mqtt to subscribe to pushed
+	// quota updates
+	Transport string `yaml:"transport"`
+
+	// Quotas are the only quota keys requested, sent as a JSON body with POST.
+	// All keys are requested with GET if empty.
+	Quotas []string `yaml:"quotas"`
+
+	// Labels are added to the metrics of the device, over the common labels
+	Labels map[string]string `yaml:"labels"`
+
+	// DisabledMetrics are not reported for the device. The names may be given
+	// without the namespace, defaults adds it.
+	DisabledMetrics []string `yaml:"disabledMetrics"`
+
+	// Online is the online flag of the device list at discovery, nil if the
+	// device wasn't listed
+	Online *bool `yaml:"-"`
+}
+
+// quotaRequest is the body of a quota request for selected keys
+type quotaRequest struct {
+	SerialNumber string `json:"sn"`
+	Params       struct {
+		Quotas []string `json:"quotas"`
+	} `json:"params"`
+}
+
+// quotaRequestBody returns the body asking for the configured quotas, nil to
+// request all of them
+func (ecoflow *Ecoflow) quotaRequestBody() ([]byte, error) {
+	if len(ecoflow.Quotas) == 0 {
+		return nil, nil
+	}
+	var request quotaRequest
+	request.SerialNumber = ecoflow.SerialNumber
+	request.Params.Quotas = ecoflow.Quotas
+	return json.Marshal(request)
+}
+
+// ExporterOptions are the settings shared by all device exporters
+type ExporterOptions struct {
+	ApiUrl       *url.URL
+	CheckTimeout time.Duration
+	// DeviceListUrl is queried for the devices of entries without serialNumber
+	DeviceListUrl *url.URL
+	// MqttCertificationUrl is queried for the broker and credentials of devices
+	// with transport mqtt
+	MqttCertificationUrl *url.URL
+	// Client is shared by all devices, so connections to the API are reused.
+	// The check timeout is applied per request.
+	Client *http.Client
+	// UserAgent is sent with every API request
+	UserAgent string
+	// MaxResponseBytes limits the size of API responses, 0 is no limit
+	MaxResponseBytes int64
+
+	// check_error hysteresis, see errorHysteresis
+	ErrorThreshold   int
+	RecoverThreshold int
+	ErrorMinHold     time.Duration
+
+	// HistorySize is the number of scrapes kept for /debug/history, 0 disables it
+	HistorySize int
+
+	// SuccessWindow is the number of scrapes ecoflow_scrape_success_ratio is computed over
+	SuccessWindow int
+
+	// StaleTelemetryPolls is the number of identical responses after which
+	// ecoflow_telemetry_stale is set, 0 disables the detection. It is never 1,
+	// a single response can't repeat.
+	StaleTelemetryPolls int
+
+	// PerDeviceRegistry puts every device on its own registry, served on
+	// <metrics-path>/<sn>
+	PerDeviceRegistry bool
+
+	// HealthInterval is how often devices are checked for /healthz/devices, 0
+	// disables the checks. HealthTimeout bounds each check.
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+
+	// PollInterval is how often devices are polled in the background, scrapes
+	// then report the last result. 0 polls on every scrape.
+	PollInterval time.Duration
+	// MinScrapeInterval is how long the last successful result is served to
+	// scrapes before the device is requested again, when polling on every scrape
+	MinScrapeInterval time.Duration
+	// PollJitter delays the first poll of every device by up to this much, so
+	// devices with the same interval don't poll at the same instant. With a
+	// non-zero PollJitterSeed the delay only depends on the seed and the serial
+	// number.
+	PollJitter     time.Duration
+	PollJitterSeed int64
+
+	// AcceptableStatus are the HTTP statuses counted as success, any 2xx if empty
+	AcceptableStatus []int
+
+	// MaxRetries is the number of retries of network errors and 5xx responses,
+	// RetryBackoff the wait before the first one, doubled on every further one
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// RetryBudget limits the retries of all devices together, nil is unlimited
+	RetryBudget *retryBudget
+	// AttemptTimeout limits the first request, every retry gets
+	// AttemptTimeoutMultiplier times the time of the one before. All of them
+	// stay within CheckTimeout, 0 only limits them by CheckTimeout.
+	AttemptTimeout           time.Duration
+	AttemptTimeoutMultiplier float64
+
+	// Semaphore bounds the API requests in flight across all devices, nil is
+	// unlimited
+	Semaphore chan struct{}
+
+	// Replay serves recorded responses instead of calling the API
+	Replay *replay
+
+	// CommonLabels are added to the metrics of all devices
+	CommonLabels map[string]string
+
+	// Models are the quota key layouts by model, nil is the table of models.yaml
+	Models *modelTable
+
+	// AvailabilityDecay is the weight of the latest scrape in ecoflow_availability
+	AvailabilityDecay float64
+
+	// DiscoveryConcurrency limits the device list requests in flight during
+	// discovery, 0 is unlimited
+	DiscoveryConcurrency int
+
+	// DebugEndpoint keeps the last raw API response of every device for
+	// /debug/devices/<sn>
+	DebugEndpoint bool
+
+	// StaleOnError sets soc, remain_time and the watts sums to NaN when a
+	// scrape fails instead of keeping the last values, except for a 429 response
+	StaleOnError bool
+
+	// StaleWhileUpdating sets them to NaN while the device installs a firmware
+	// update
+	StaleWhileUpdating bool
+
+	// Now is the clock of the device state, time.Now if nil
+	Now func() time.Time
 }
 
 type EcoflowExporter struct {
 	ecoflow      *Ecoflow
-	checkTimeout time.Duration
+	options      ExporterOptions
 	mutex        sync.RWMutex
 	checkError   prometheus.Gauge
+	checkRaw     prometheus.Gauge
+	up           prometheus.Gauge
+	duration     prometheus.Gauge
+	lastPoll     prometheus.Gauge
+	staleness    prometheus.Gauge
+	started      time.Time
+	lastSuccess  time.Time
+	errorState   errorHysteresis
+	history      *scrapeHistory
+	successRatio prometheus.Gauge
+	successes    successWindow
+	availability prometheus.Gauge
+	available    float64
+	scraped      bool
+	scrapes      prometheus.Counter
 	soc          prometheus.Gauge
 	remaintime   prometheus.Gauge
 	wattsoutsum  prometheus.Gauge
 	wattsinsum   prometheus.Gauge
+	remainenergy prometheus.Gauge
+	responsesize prometheus.Gauge
+	requestsize  prometheus.Gauge
+	chargewh     prometheus.Gauge
+	dischargewh  prometheus.Gauge
+	charge       energySession
+	discharge    energySession
+	device       *prometheus.Desc
+	account      prometheus.Gauge
+	socrange     *extremes
+	inrange      *extremes
+	outrange     *extremes
+	derived      []derivedMetric
+	quota        []quotaMetric
+	stale        prometheus.Gauge
+	updating     prometheus.Gauge
+	dataHash     uint64
+	authFailure  prometheus.Gauge
+	authSince    time.Time
+	socChange    prometheus.Gauge
+	prevSoc      float64
+	prevSocTime  time.Time
+	registry     *prometheus.Registry
+	lastResponse debugResponse
+	names        metricNames
+	disabled     map[*prometheus.Desc]bool
+	health       deviceHealthState
+	identical    int
+	data         EcoflowApiData
+	quotaData    quota
+	apiCode      *prometheus.Desc
+	wattsIn      *prometheus.Desc
+	wattsOut     *prometheus.Desc
+	batteryTemp  *prometheus.Desc
+	cycles       *prometheus.Desc
+	timeToFull   *prometheus.Desc
+	timeToEmpty  *prometheus.Desc
+	inputVolts   *prometheus.Desc
+	outputVolts  *prometheus.Desc
+	inputAmps    *prometheus.Desc
+	outputAmps   *prometheus.Desc
+	solarWatts   *prometheus.Desc
+	solarVolts   *prometheus.Desc
+	solarAmps    *prometheus.Desc
+	generatedWh  *prometheus.Desc
+	solarCharge  *prometheus.Desc
+	acTargetVolt *prometheus.Desc
+	acTargetFreq *prometheus.Desc
+	outputOn     *prometheus.Desc
+	generated    generationCounter
+	rateLimited  prometheus.Gauge
+	online       prometheus.Gauge
+	onlineKnown  bool
+	offline      bool
+	limitedUntil time.Time
+	code         string
+	message      string
+	ok           bool
+	stop         context.CancelFunc
+	workers      sync.WaitGroup
+}
+
+// responseCode is the code of an API response, sent both as a string and as a
+// number depending on the API version
+type responseCode string
+
+func (code *responseCode) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case string:
+		*code = responseCode(value)
+	case json.Number:
+		*code = responseCode(value.String())
+	case nil:
+		*code = ""
+	default:
+		return fmt.Errorf("code must be a string or a number, got %s", data)
+	}
+	return nil
 }
 
 type EcoflowApi struct {
-	Code    string
+	Code    responseCode
 	Message string
-	Data    EcoflowApiData
+	Data    quota
+
+	// ResponseBytes is the size of the raw response body
+	ResponseBytes int `json:"-"`
+	// RequestBytes is the size of the request body, 0 for the GET of all quotas
+	RequestBytes int `json:"-"`
+	StatusCode   int `json:"-"`
+	// RetryAfter is how long to back off after a 429 response
+	RetryAfter time.Duration `json:"-"`
+	// Body is the raw response, kept for --enable-debug-endpoint
+	Body []byte `json:"-"`
 }
 
 type EcoflowApiData struct {
@@ -48,205 +419,2339 @@ type EcoflowApiData struct {
 	RemainTime  float64
 	WattsOutSum float64
 	WattsInSum  float64
+	Model       string
+	Firmware    string
+	CapacityWh  float64
 }
 
-func (params *Ecoflow) defaults() {
+// defaults fills the unset fields, including the keys of the referenced account
+func (params *Ecoflow) defaults(credentials map[string]Credentials) error {
+	var err error
+	if params.AppKey, err = resolveKey("appKey", params.AppKey, params.AppKeyFile); err != nil {
+		return fmt.Errorf("device %s: %w", params.SerialNumber, err)
+	}
+	if params.SecretKey, err = resolveKey("secretKey", params.SecretKey, params.SecretKeyFile); err != nil {
+		return fmt.Errorf("device %s: %w", params.SerialNumber, err)
+	}
+
+	if params.Account != "" {
+		account, ok := credentials[params.Account]
+		if !ok {
+			return fmt.Errorf("unknown account %q of device %s", params.Account, params.SerialNumber)
+		}
+		// keys given on the device win
+		if params.AppKey == "" {
+			params.AppKey = account.AppKey
+		}
+		if params.SecretKey == "" {
+			params.SecretKey = account.SecretKey
+		}
+	}
 	if params.Description == "" {
 		params.Description = params.SerialNumber
 	}
+	for i, name := range params.DisabledMetrics {
+		if !strings.HasPrefix(name, namespace+"_") {
+			params.DisabledMetrics[i] = namespace + "_" + name
+		}
+	}
+	return nil
+}
+
+// deviceInfo returns the device model and capacity. Values reported by the API win
+// over the config ones unless preferConfig is set; an empty value from one source
+// always falls back to the other.
+func (params *Ecoflow) deviceInfo(data EcoflowApiData) (string, float64) {
+	model, capacity := data.Model, data.CapacityWh
+	if model == "" || (params.PreferConfig && params.Model != "") {
+		model = params.Model
+	}
+	if capacity == 0 || (params.PreferConfig && params.CapacityWh > 0) {
+		capacity = params.CapacityWh
+	}
+	return model, capacity
+}
+
+// exporterOptions applies the device overrides to the global options
+func (params *Ecoflow) exporterOptions(options ExporterOptions) ExporterOptions {
+	if params.CheckTimeout > 0 {
+		options.CheckTimeout = params.CheckTimeout
+	}
+	if params.AttemptTimeout > 0 {
+		options.AttemptTimeout = params.AttemptTimeout
+	}
+	if params.AttemptTimeoutMultiplier > 0 {
+		options.AttemptTimeoutMultiplier = params.AttemptTimeoutMultiplier
+	}
+	return options
+}
+
+// appKeyFingerprint returns a short stable hash identifying the account without
+// exposing the key
+func appKeyFingerprint(appKey string) string {
+	sum := sha256.Sum256([]byte(appKey))
+	return hex.EncodeToString(sum[:])[:12]
 }
 
-func CreateExporters(ecoflow Ecoflow, checkTimeout time.Duration) (*EcoflowExporter, error) {
-	return &EcoflowExporter{
-		ecoflow:      &ecoflow,
-		checkTimeout: checkTimeout,
+func CreateExporters(ecoflow Ecoflow, options ExporterOptions) (*EcoflowExporter, error) {
+	options = ecoflow.exporterOptions(options)
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+
+	// per device labels win over common ones
+	labels := prometheus.Labels{}
+	for name, value := range options.CommonLabels {
+		labels[name] = value
+	}
+	for name, value := range ecoflow.Labels {
+		labels[name] = value
+	}
+	labels["description"] = ecoflow.Description
+	labels["sn"] = ecoflow.SerialNumber
+
+	accountLabels := prometheus.Labels{"account": appKeyFingerprint(ecoflow.AppKey)}
+	for name, value := range labels {
+		accountLabels[name] = value
+	}
+
+	var history *scrapeHistory
+	if options.HistorySize > 0 {
+		history = newScrapeHistory(options.HistorySize)
+	}
+
+	named := metricNames{}
+	exporter := &EcoflowExporter{
+		ecoflow: &ecoflow,
+		names:   named,
+		options: options,
+		started: options.Now(),
+		errorState: errorHysteresis{
+			up:   options.ErrorThreshold,
+			down: options.RecoverThreshold,
+			hold: options.ErrorMinHold,
+		},
+		history:   history,
+		successes: newSuccessWindow(options.SuccessWindow),
 
-		soc: prometheus.NewGauge(prometheus.GaugeOpts{
+		soc: named.gauge(prometheus.GaugeOpts{
 			Namespace:   namespace,
 			Name:        "soc",
 			Help:        "State of charge",
-			ConstLabels: prometheus.Labels{"description": fmt.Sprintf("%s", ecoflow.Description), "sn": fmt.Sprintf("%s", ecoflow.SerialNumber)},
+			ConstLabels: labels,
 		}),
 
-		remaintime: prometheus.NewGauge(prometheus.GaugeOpts{
+		remaintime: named.gauge(prometheus.GaugeOpts{
 			Namespace:   namespace,
 			Name:        "remain_time",
 			Help:        "Remain time",
-			ConstLabels: prometheus.Labels{"description": fmt.Sprintf("%s", ecoflow.Description), "sn": fmt.Sprintf("%s", ecoflow.SerialNumber)},
+			ConstLabels: labels,
 		}),
 
-		wattsoutsum: prometheus.NewGauge(prometheus.GaugeOpts{
+		wattsoutsum: named.gauge(prometheus.GaugeOpts{
 			Namespace:   namespace,
 			Name:        "watts_out_sum",
 			Help:        "Current wats output",
-			ConstLabels: prometheus.Labels{"description": fmt.Sprintf("%s", ecoflow.Description), "sn": fmt.Sprintf("%s", ecoflow.SerialNumber)},
+			ConstLabels: labels,
 		}),
 
-		wattsinsum: prometheus.NewGauge(prometheus.GaugeOpts{
+		wattsinsum: named.gauge(prometheus.GaugeOpts{
 			Namespace:   namespace,
 			Name:        "watts_in_sum",
 			Help:        "Current wats input",
-			ConstLabels: prometheus.Labels{"description": fmt.Sprintf("%s", ecoflow.Description), "sn": fmt.Sprintf("%s", ecoflow.SerialNumber)},
+			ConstLabels: labels,
+		}),
+
+		remainenergy: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "remain_energy_wh",
+			Help:        "Remaining energy, soc * capacity",
+			ConstLabels: labels,
+		}),
+
+		responsesize: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "api_response_bytes",
+			Help:        "Size of the last API response body",
+			ConstLabels: labels,
+		}),
+
+		requestsize: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "api_request_bytes",
+			Help:        "Size of the last API request body, 0 unless quotas are configured",
+			ConstLabels: labels,
+		}),
+
+		chargewh: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "last_charge_session_wh",
+			Help:        "Energy added during the last finished charge session",
+			ConstLabels: labels,
+		}),
+
+		dischargewh: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "last_discharge_session_wh",
+			Help:        "Energy drawn during the last finished discharge session",
+			ConstLabels: labels,
+		}),
+
+		device: named.desc(
+			prometheus.BuildFQName(namespace, "", "device"),
+			"Device metadata, always 1, model and firmware are unknown until known from the API or config",
+			[]string{"model", "firmware", "link_group", "alias"}, labels,
+		),
+
+		wattsIn: named.desc(
+			prometheus.BuildFQName(namespace, "", "watts_in"),
+			"Current watts input by channel: ac or solar",
+			[]string{"channel"}, labels,
+		),
+
+		wattsOut: named.desc(
+			prometheus.BuildFQName(namespace, "", "watts_out"),
+			"Current watts output by channel: ac, dc or usb",
+			[]string{"channel"}, labels,
+		),
+
+		inputVolts: named.desc(
+			prometheus.BuildFQName(namespace, "", "input_volts"),
+			"Input voltage by channel: ac or solar",
+			[]string{"channel"}, labels,
+		),
+
+		outputVolts: named.desc(
+			prometheus.BuildFQName(namespace, "", "output_volts"),
+			"Output voltage by channel: ac or dc",
+			[]string{"channel"}, labels,
+		),
+
+		inputAmps: named.desc(
+			prometheus.BuildFQName(namespace, "", "input_amps"),
+			"Input current by channel: ac or solar",
+			[]string{"channel"}, labels,
+		),
+
+		outputAmps: named.desc(
+			prometheus.BuildFQName(namespace, "", "output_amps"),
+			"Output current by channel: ac or dc",
+			[]string{"channel"}, labels,
+		),
+
+		solarWatts: named.desc(
+			prometheus.BuildFQName(namespace, "", "solar_input_watts"),
+			"Solar input power by PV input",
+			[]string{"pv"}, labels,
+		),
+
+		solarVolts: named.desc(
+			prometheus.BuildFQName(namespace, "", "solar_input_volts"),
+			"Solar input voltage by PV input",
+			[]string{"pv"}, labels,
+		),
+
+		solarAmps: named.desc(
+			prometheus.BuildFQName(namespace, "", "solar_input_amps"),
+			"Solar input current by PV input",
+			[]string{"pv"}, labels,
+		),
+
+		generatedWh: named.desc(
+			prometheus.BuildFQName(namespace, "", "solar_generated_wh_total"),
+			"Solar energy generated as reported by the device, device resets don't decrease it",
+			nil, labels,
+		),
+
+		acTargetVolt: named.desc(
+			prometheus.BuildFQName(namespace, "", "ac_output_target_voltage"),
+			"AC output voltage the inverter is configured for, only for models with a configurable output",
+			nil, labels,
+		),
+		acTargetFreq: named.desc(
+			prometheus.BuildFQName(namespace, "", "ac_output_target_frequency"),
+			"AC output frequency in Hz the inverter is configured for, only for models with a configurable output",
+			nil, labels,
+		),
+
+		solarCharge: named.desc(
+			prometheus.BuildFQName(namespace, "", "solar_charge_efficiency"),
+			"Battery charge watts per solar input watts of the same poll, a derived estimate that counts other charge sources too, NaN without solar input",
+			nil, labels,
+		),
+
+		outputOn: named.desc(
+			prometheus.BuildFQName(namespace, "", "output_enabled"),
+			"Whether the output port is switched on: ac, dc or usb",
+			[]string{"port"}, labels,
+		),
+
+		batteryTemp: named.desc(
+			prometheus.BuildFQName(namespace, "", "battery_temp_celsius"),
+			"Battery temperature by BMS, 0 is the master",
+			[]string{"bms"}, labels,
+		),
+
+		cycles: named.desc(
+			prometheus.BuildFQName(namespace, "", "battery_cycles"),
+			"Battery charge cycles by BMS, 0 is the master",
+			[]string{"bms"}, labels,
+		),
+
+		timeToFull: named.desc(
+			prometheus.BuildFQName(namespace, "", "time_to_full_seconds"),
+			"Remaining time until the battery is full, only while charging",
+			nil, labels,
+		),
+
+		timeToEmpty: named.desc(
+			prometheus.BuildFQName(namespace, "", "time_to_empty_seconds"),
+			"Remaining time until the battery is empty, only while discharging",
+			nil, labels,
+		),
+
+		apiCode: named.desc(
+			prometheus.BuildFQName(namespace, "", "api_code"),
+			"Code of the last API response, 0 is success, labeled with its message",
+			[]string{"message"}, labels,
+		),
+
+		account: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "account_info",
+			Help:        "Account the device belongs to, always 1",
+			ConstLabels: accountLabels,
 		}),
 
-		checkError: prometheus.NewGauge(prometheus.GaugeOpts{
+		socrange: newExtremes(named, "soc", "state of charge", labels),
+		inrange:  newExtremes(named, "watts_in_sum", "wats input", labels),
+		outrange: newExtremes(named, "watts_out_sum", "wats output", labels),
+
+		checkError: named.gauge(prometheus.GaugeOpts{
 			Namespace:   namespace,
 			Name:        "check_error",
 			Help:        "check error",
-			ConstLabels: prometheus.Labels{"description": fmt.Sprintf("%s", ecoflow.Description), "sn": fmt.Sprintf("%s", ecoflow.SerialNumber)},
+			ConstLabels: labels,
 		}),
-	}, nil
-}
 
-func (ecoflow *EcoflowExporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- ecoflow.soc.Desc()
-	ch <- ecoflow.remaintime.Desc()
-	ch <- ecoflow.wattsinsum.Desc()
-	ch <- ecoflow.wattsoutsum.Desc()
-	ch <- ecoflow.checkError.Desc()
-}
+		successRatio: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "scrape_success_ratio",
+			Help:        "Ratio of successful scrapes over the last --success-window scrapes",
+			ConstLabels: labels,
+		}),
 
-func (ecoflow *EcoflowExporter) Collect(ch chan<- prometheus.Metric) {
-	ecoflow.mutex.Lock()
-	defer func() {
-		ch <- ecoflow.soc
-		ch <- ecoflow.remaintime
-		ch <- ecoflow.wattsinsum
-		ch <- ecoflow.wattsoutsum
-		ch <- ecoflow.checkError
-		ecoflow.mutex.Unlock()
-	}()
+		availability: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "availability",
+			Help:        "Exponentially weighted moving fraction of successful scrapes",
+			ConstLabels: labels,
+		}),
 
-	res, err := getEcoflowApiData(ecoflow.ecoflow, ecoflow.checkTimeout)
+		stale: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "telemetry_stale",
+			Help:        "Device returned identical data for --stale-telemetry-polls polls in a row",
+			ConstLabels: labels,
+		}),
 
-	if err != nil || "0" != res.Code {
-		ecoflow.checkError.Set(float64(1))
-		return
-	}
+		updating: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "device_updating",
+			Help:        "Device installs a firmware update and its telemetry is unreliable, 0 if the device doesn't report it",
+			ConstLabels: labels,
+		}),
 
-	ecoflow.soc.Set(res.Data.Soc)
-	ecoflow.remaintime.Set(res.Data.RemainTime)
-	ecoflow.wattsinsum.Set(res.Data.WattsInSum)
-	ecoflow.wattsoutsum.Set(res.Data.WattsOutSum)
-}
+		authFailure: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "auth_failure_seconds",
+			Help:        "Seconds since the API started rejecting the credentials with HTTP 401/403 or the codes 8513 (invalid appKey) and 8521 (wrong signature), 0 when accepted",
+			ConstLabels: labels,
+		}),
 
-func getEcoflowApiData(ecoflow *Ecoflow, checkTimeout time.Duration) (EcoflowApi, error) {
-	// TODO: get url from args/env
-	url := fmt.Sprintf("https://api.ecoflow.com/iot-service/open/api/device/queryDeviceQuota?sn=%s", ecoflow.SerialNumber)
-	httpClient := http.Client{
-		Timeout: checkTimeout, // Timeout after 2 seconds
-	}
+		socChange: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "soc_change_per_minute",
+			Help:        "State of charge change per minute between the last two successful scrapes",
+			ConstLabels: labels,
+		}),
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
+		up: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "up",
+			Help:        "Whether the last scrape of the device was successful",
+			ConstLabels: labels,
+		}),
 
-	req.Header.Set("User-Agent", "prometheus-ecoflow-exporter")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("appKey", ecoflow.AppKey)
-	req.Header.Set("secretKey", ecoflow.SecretKey)
+		duration: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "scrape_duration_seconds",
+			Help:        "Duration of the last device scrape",
+			ConstLabels: labels,
+		}),
 
-	res, getErr := httpClient.Do(req)
-	if getErr != nil {
-		return EcoflowApi{}, getErr
-	}
+		lastPoll: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "last_poll_timestamp_seconds",
+			Help:        "Time of the last poll of the device, successful or not",
+			ConstLabels: labels,
+		}),
 
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
+		staleness: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "data_staleness_seconds",
+			Help:        "Age of the data of the last successful poll, the time since startup while none succeeded",
+			ConstLabels: labels,
+		}),
+
+		online: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "device_online",
+			Help:        "Whether the device list or the quota data reports the device online, soc, remain_time and the watts sums are NaN while it is offline",
+			ConstLabels: labels,
+		}),
+
+		rateLimited: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "rate_limited",
+			Help:        "Whether polls of the device are suspended after a 429 response of the API",
+			ConstLabels: labels,
+		}),
+
+		checkRaw: named.gauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "check_error_raw",
+			Help:        "check error of the last scrape, without hysteresis",
+			ConstLabels: labels,
+		}),
+
+		scrapes: named.counter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "scrapes_total",
+			Help:        "Total number of collections of the device, including the ones served from cached values",
+			ConstLabels: labels,
+		}),
+	}
+	exporter.account.Set(1)
+	// there is no rate before the second successful scrape
+	exporter.socChange.Set(math.NaN())
+	if ecoflow.Online != nil {
+		exporter.setOnline(*ecoflow.Online)
+	}
 
+	names := make(map[string]string)
+	for _, key := range ecoflow.Metrics {
+		name := quotaMetricName(key)
+		valueType := prometheus.GaugeValue
+		if quotaMetricType(key, ecoflow.MetricTypes) == metricTypeCounter {
+			name += "_total"
+			valueType = prometheus.CounterValue
+		}
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("metrics %q and %q of %s have the same name %s", other, key, ecoflow.SerialNumber, name)
 		}
-	}(res.Body)
+		names[name] = key
+		exporter.quota = append(exporter.quota, quotaMetric{
+			key:       key,
+			desc:      named.desc(prometheus.BuildFQName(namespace, "", name), "Quota field "+key, nil, labels),
+			valueType: valueType,
+		})
+	}
 
-	body, readErr := io.ReadAll(res.Body)
-	if readErr != nil {
-		return EcoflowApi{}, readErr
+	for _, name := range ecoflow.PostProcessors {
+		processor, ok := postProcessors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown post processor %q for %s", name, ecoflow.SerialNumber)
+		}
+		exporter.derived = append(exporter.derived, derivedMetric{
+			processor: processor,
+			gauge: named.gauge(prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        name,
+				Help:        processor.help,
+				ConstLabels: labels,
+			}),
+		})
 	}
 
-	var ecoflowData EcoflowApi
-	jsonErr := json.Unmarshal(body, &ecoflowData)
-	if jsonErr != nil {
-		return EcoflowApi{}, jsonErr
+	disabled, err := exporter.disabledDescs(ecoflow.DisabledMetrics)
+	if err != nil {
+		return nil, err
 	}
+	exporter.disabled = disabled
 
-	return ecoflowData, nil
+	return exporter, nil
 }
 
-func main() {
-
-	var listen string
-	listenDefault := "0.0.0.0:9136"
-	pflag.StringVar(&listen, "listen", listenDefault, "Listen address. Env LISTEN also can be used.")
+func (ecoflow *EcoflowExporter) Describe(ch chan<- *prometheus.Desc) {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		ecoflow.describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		if !ecoflow.disabled[desc] {
+			ch <- desc
+		}
+	}
+}
 
-	var configFile string
-	configFileDefault := "/etc/prometheus/prometheus-ecoflow-exporter.yaml"
-	pflag.StringVar(&configFile, "config-file", configFileDefault, "Config file")
+// describe sends the descs of all metrics, disabled ones included
+func (ecoflow *EcoflowExporter) describe(ch chan<- *prometheus.Desc) {
+	ch <- ecoflow.soc.Desc()
+	ch <- ecoflow.remaintime.Desc()
+	ch <- ecoflow.wattsinsum.Desc()
+	ch <- ecoflow.wattsoutsum.Desc()
+	ch <- ecoflow.remainenergy.Desc()
+	ch <- ecoflow.checkError.Desc()
+	ch <- ecoflow.checkRaw.Desc()
+	ch <- ecoflow.up.Desc()
+	ch <- ecoflow.duration.Desc()
+	ch <- ecoflow.lastPoll.Desc()
+	ch <- ecoflow.staleness.Desc()
+	ch <- ecoflow.rateLimited.Desc()
+	ch <- ecoflow.online.Desc()
+	ch <- ecoflow.stale.Desc()
+	ch <- ecoflow.updating.Desc()
+	ch <- ecoflow.authFailure.Desc()
+	ch <- ecoflow.socChange.Desc()
+	ch <- ecoflow.successRatio.Desc()
+	ch <- ecoflow.availability.Desc()
+	ch <- ecoflow.scrapes.Desc()
+	ch <- ecoflow.responsesize.Desc()
+	ch <- ecoflow.requestsize.Desc()
+	ch <- ecoflow.chargewh.Desc()
+	ch <- ecoflow.dischargewh.Desc()
+	ch <- ecoflow.device
+	ch <- ecoflow.apiCode
+	ch <- ecoflow.wattsIn
+	ch <- ecoflow.wattsOut
+	ch <- ecoflow.inputVolts
+	ch <- ecoflow.outputVolts
+	ch <- ecoflow.inputAmps
+	ch <- ecoflow.outputAmps
+	ch <- ecoflow.solarWatts
+	ch <- ecoflow.solarVolts
+	ch <- ecoflow.solarAmps
+	ch <- ecoflow.generatedWh
+	ch <- ecoflow.solarCharge
+	ch <- ecoflow.acTargetVolt
+	ch <- ecoflow.acTargetFreq
+	ch <- ecoflow.outputOn
+	ch <- ecoflow.batteryTemp
+	ch <- ecoflow.cycles
+	ch <- ecoflow.timeToFull
+	ch <- ecoflow.timeToEmpty
+	ch <- ecoflow.account.Desc()
+	ecoflow.socrange.describe(ch)
+	ecoflow.inrange.describe(ch)
+	ecoflow.outrange.describe(ch)
+	for _, metric := range ecoflow.derived {
+		ch <- metric.gauge.Desc()
+	}
+	for _, metric := range ecoflow.quota {
+		ch <- metric.desc
+	}
+}
 
-	var metricsPath string
-	metricsPathDefault := "/metrics"
-	pflag.StringVar(&metricsPath, "metrics-path", metricsPathDefault, "Metrics path")
+func (ecoflow *EcoflowExporter) Collect(ch chan<- prometheus.Metric) {
+	ecoflow.scrape(context.Background(), ch)
+}
 
-	var checkTimeout time.Duration
-	checkTimeoutDefault := 5 * time.Second
-	pflag.DurationVar(&checkTimeout, "check_timeout", checkTimeoutDefault, "Check timeout")
+// scrape is Collect bound to the context of the scrape request, a canceled
+// scrape cancels the API request as well
+func (ecoflow *EcoflowExporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) {
+	ecoflow.mutex.Lock()
+	defer ecoflow.mutex.Unlock()
+	ecoflow.scrapes.Inc()
 
-	pflag.Parse()
+	ch, done := filterMetrics(ch, ecoflow.disabled)
+	defer done()
 
-	if listen == listenDefault && len(os.Getenv("LISTEN")) > 0 {
-		listen = os.Getenv("LISTEN")
+	// with --poll-interval the poller keeps the values up to date, with mqtt
+	// the subscription
+	polled := ecoflow.options.PollInterval == 0 && ecoflow.ecoflow.Transport != transportMqtt
+	if polled && ecoflow.limited() {
+		rateLimitWaits.WithLabelValues("retry_after").Inc()
+		polled = false
 	}
-
-	if configFile == configFileDefault && len(os.Getenv("CONFIG_FILE")) > 0 {
-		configFile = os.Getenv("CONFIG_FILE")
+	if polled {
+		if ecoflow.cached() {
+			cacheHits.WithLabelValues(ecoflow.ecoflow.SerialNumber).Inc()
+			ecoflow.collect(ch)
+			return
+		}
+		start := time.Now()
+		res, err := ecoflow.fetch(ctx)
+		// nobody waits for the result of a canceled scrape, it is no device failure
+		if ctx.Err() == nil {
+			ecoflow.update(res, err, time.Since(start))
+		}
 	}
+	ecoflow.collect(ch)
+}
 
-	if metricsPath == metricsPathDefault && len(os.Getenv("METRICS_PATH")) > 0 {
-		metricsPath = os.Getenv("METRICS_PATH")
+// cached tells whether the last successful result is younger than
+// MinScrapeInterval
+func (ecoflow *EcoflowExporter) cached() bool {
+	return ecoflow.options.MinScrapeInterval > 0 && !ecoflow.lastSuccess.IsZero() &&
+		ecoflow.options.Now().Sub(ecoflow.lastSuccess) < ecoflow.options.MinScrapeInterval
+}
+
+// poller polls the device every PollInterval, independently of the scrapes.
+// The mutex is only held to store the result, so scrapes never wait for the API.
+func (ecoflow *EcoflowExporter) poller(ctx context.Context) {
+	offset := pollOffset(ecoflow.ecoflow.SerialNumber, ecoflow.options.PollJitter, ecoflow.options.PollJitterSeed)
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(offset):
 	}
 
-	if checkTimeout == checkTimeoutDefault && len(os.Getenv("CHECK_TIMEOUT")) > 0 {
-		var err error
-		checkTimeout, err = time.ParseDuration(os.Getenv("CHECK_TIMEOUT"))
-		if err != nil {
-			panic(err)
+	for {
+		ecoflow.mutex.RLock()
+		limited := ecoflow.limited()
+		ecoflow.mutex.RUnlock()
+
+		if limited {
+			rateLimitWaits.WithLabelValues("retry_after").Inc()
+		} else {
+			start := time.Now()
+			res, err := ecoflow.fetch(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			ecoflow.mutex.Lock()
+			ecoflow.update(res, err, time.Since(start))
+			ecoflow.mutex.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ecoflow.options.PollInterval):
 		}
 	}
+}
 
-	var ecoflowListConfig = make([]Ecoflow, 256)
-	var ecoflowList = make(map[string]Ecoflow, 256)
+// pollOffset returns the delay of the first poll of the device, random up to
+// jitter, derived from the serial number if seed is given
+func pollOffset(sn string, jitter time.Duration, seed int64) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	if seed == 0 {
+		return time.Duration(rand.Int63n(int64(jitter)))
+	}
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, seed)
+	h.Write([]byte(sn))
+	return time.Duration(h.Sum64() % uint64(jitter))
+}
 
-	config, err := os.ReadFile(configFile)
-	if err != nil {
-		log.Fatal("Couldn't read config: ", err)
+// start runs the background poller or MQTT subscription and the health check
+// if enabled, until ctx is done or shutdown is called
+func (ecoflow *EcoflowExporter) start(ctx context.Context) {
+	ctx, ecoflow.stop = context.WithCancel(ctx)
+	if ecoflow.options.HealthInterval > 0 {
+		ecoflow.workers.Add(1)
+		go func() {
+			defer ecoflow.workers.Done()
+			ecoflow.healthCheck(ctx)
+		}()
 	}
+	switch {
+	case ecoflow.ecoflow.Transport == transportMqtt:
+		ecoflow.workers.Add(1)
+		go func() {
+			defer ecoflow.workers.Done()
+			ecoflow.subscribe(ctx)
+		}()
+	case ecoflow.options.PollInterval > 0:
+		ecoflow.workers.Add(1)
+		go func() {
+			defer ecoflow.workers.Done()
+			ecoflow.poller(ctx)
+		}()
+	}
+}
 
-	err = yaml.Unmarshal(config, &ecoflowListConfig)
-	if err != nil {
-		log.Fatal("Couldn't parse config: ", err)
+// shutdown stops the background goroutines and waits for a running poll or
+// check to finish, which the check timeout bounds
+func (ecoflow *EcoflowExporter) shutdown() {
+	if ecoflow.stop != nil {
+		ecoflow.stop()
 	}
+	ecoflow.workers.Wait()
+}
 
-	for ecoflow := range ecoflowListConfig {
-		if _, ok := ecoflowList[ecoflowListConfig[ecoflow].SerialNumber]; !ok {
-			t := ecoflowListConfig[ecoflow]
-			t.defaults()
-			ecoflowList[ecoflowListConfig[ecoflow].SerialNumber] = t
+// register puts the exporter on its own registry with --per-device-registry,
+// on the shared one otherwise. Link group members are collected by their group,
+// they never go on the shared registry.
+func (ecoflow *EcoflowExporter) register(shared *prometheus.Registry) error {
+	if !ecoflow.options.PerDeviceRegistry {
+		if ecoflow.ecoflow.LinkGroup != "" {
+			return nil
 		}
+		return shared.Register(ecoflow)
+	}
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(ecoflow); err != nil {
+		return err
+	}
+	ecoflow.registry = registry
+	return nil
+}
+
+// unregister takes the exporter off the shared registry, if register put it
+// there
+func (ecoflow *EcoflowExporter) unregister(shared *prometheus.Registry) {
+	if !ecoflow.options.PerDeviceRegistry && ecoflow.ecoflow.LinkGroup == "" {
+		shared.Unregister(ecoflow)
 	}
+}
 
-	for _, ecoflow := range ecoflowList {
-		exporter, err := CreateExporters(ecoflow, checkTimeout)
+// limited tells if polls are suspended after a 429 response, the last values
+// are reported meanwhile. The caller holds the mutex.
+func (ecoflow *EcoflowExporter) limited() bool {
+	return ecoflow.options.Now().Before(ecoflow.limitedUntil)
+}
+
+// update stores the result of a poll, the caller holds the mutex
+func (ecoflow *EcoflowExporter) update(res EcoflowApi, err error, duration time.Duration) {
+	ecoflow.lastPoll.Set(float64(ecoflow.options.Now().Unix()))
+	ecoflow.duration.Set(duration.Seconds())
+	ecoflow.responsesize.Set(float64(res.ResponseBytes))
+	ecoflow.requestsize.Set(float64(res.RequestBytes))
+	ecoflow.updateAuthFailure(res, err)
+	if ecoflow.options.DebugEndpoint {
+		ecoflow.lastResponse = debugResponse{Time: ecoflow.options.Now(), StatusCode: res.StatusCode, Body: string(res.Body)}
 		if err != nil {
-			log.Fatal(err)
+			ecoflow.lastResponse.Error = err.Error()
 		}
-		prometheus.MustRegister(exporter)
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		ecoflow.limitedUntil = ecoflow.options.Now().Add(res.RetryAfter)
+	}
+	// the code is only known when the API answered
+	ecoflow.code, ecoflow.message = "", ""
+	if err == nil {
+		ecoflow.code, ecoflow.message = string(res.Code), res.Message
 	}
 
-	log.Printf("Statring ecoflow exporter on %s", listen)
+	if err != nil || "0" != res.Code {
+		ecoflow.setCheckResult(false)
+		failure := fmt.Sprintf("code %s, %s", res.Code, res.Message)
+		if err != nil {
+			failure = err.Error()
+		}
+		slog.Warn("Device scrape failed", "sn", ecoflow.ecoflow.SerialNumber, "error", failure)
+		if ecoflow.history != nil {
+			ecoflow.history.add(scrapeRecord{Time: ecoflow.options.Now(), Error: failure})
+		}
+		// while rate limited the last good values are reported, the device
+		// isn't down
+		if ecoflow.options.StaleOnError && res.StatusCode != http.StatusTooManyRequests {
+			ecoflow.setStale()
+		}
+		return
+	}
+	ecoflow.setCheckResult(true)
+	ecoflow.lastSuccess = ecoflow.options.Now()
+	data := res.Data.apiData()
+	slog.Debug("Device scraped", "sn", ecoflow.ecoflow.SerialNumber, "duration", duration, "soc", data.Soc)
+	if ecoflow.history != nil {
+		ecoflow.history.add(scrapeRecord{Time: ecoflow.options.Now(), Ok: true, Soc: data.Soc, WattsInSum: data.WattsInSum, WattsOutSum: data.WattsOutSum})
+	}
+
+	// a hung device keeps returning the very same values, identical counts the
+	// repeats, the first response of a run isn't one
+	if hash := res.Data.hash(); hash == ecoflow.dataHash {
+		ecoflow.identical++
+	} else {
+		ecoflow.identical = 0
+		ecoflow.dataHash = hash
+	}
+	if ecoflow.options.StaleTelemetryPolls > 0 && ecoflow.identical+1 >= ecoflow.options.StaleTelemetryPolls {
+		ecoflow.stale.Set(1)
+	} else {
+		ecoflow.stale.Set(0)
+	}
+
+	ecoflow.data = data
+	ecoflow.quotaData = res.Data
+	model, _ := ecoflow.ecoflow.deviceInfo(data)
+	if key := ecoflow.options.Models.metersOf(model).generated; key != "" {
+		if total, ok := res.Data.number(key); ok {
+			ecoflow.generated.update(total)
+		}
+	}
+	for i := range ecoflow.quota {
+		ecoflow.quota[i].update(res.Data)
+	}
+	// the quota flag is more recent than the one of the device list
+	if online, ok := res.Data.number("online"); ok {
+		ecoflow.setOnline(online != 0)
+	}
+	ecoflow.soc.Set(data.Soc)
+	ecoflow.remaintime.Set(data.RemainTime)
+	ecoflow.wattsinsum.Set(data.WattsInSum)
+	ecoflow.wattsoutsum.Set(data.WattsOutSum)
+	updating := res.Data.updating()
+	if updating {
+		ecoflow.updating.Set(1)
+	} else {
+		ecoflow.updating.Set(0)
+	}
+	// an offline device answers with the values it had when it went away
+	if ecoflow.offline || updating && ecoflow.options.StaleWhileUpdating {
+		ecoflow.setStale()
+	}
+	ecoflow.socrange.update(data.Soc)
+	ecoflow.inrange.update(data.WattsInSum)
+	ecoflow.outrange.update(data.WattsOutSum)
+
+	now := ecoflow.options.Now()
+	if elapsed := now.Sub(ecoflow.prevSocTime).Minutes(); !ecoflow.prevSocTime.IsZero() && elapsed > 0 {
+		ecoflow.socChange.Set((data.Soc - ecoflow.prevSoc) / elapsed)
+	}
+	ecoflow.prevSoc = data.Soc
+	ecoflow.prevSocTime = now
+
+	// sessions follow the net power flow of the battery
+	ecoflow.charge.update(data.WattsInSum-data.WattsOutSum, now)
+	ecoflow.discharge.update(data.WattsOutSum-data.WattsInSum, now)
+	ecoflow.chargewh.Set(ecoflow.charge.last)
+	ecoflow.dischargewh.Set(ecoflow.discharge.last)
+}
+
+// setOnline stores the online flag of the device, the caller holds the mutex
+func (ecoflow *EcoflowExporter) setOnline(online bool) {
+	ecoflow.onlineKnown = true
+	ecoflow.offline = !online
+	if online {
+		ecoflow.online.Set(1)
+		return
+	}
+	ecoflow.online.Set(0)
+	ecoflow.setStale()
+}
+
+// setStale sets the battery and watts gauges to NaN, the caller holds the mutex
+func (ecoflow *EcoflowExporter) setStale() {
+	ecoflow.soc.Set(math.NaN())
+	ecoflow.remaintime.Set(math.NaN())
+	ecoflow.wattsinsum.Set(math.NaN())
+	ecoflow.wattsoutsum.Set(math.NaN())
+}
+
+// collect sends the stored values, the caller holds the mutex
+func (ecoflow *EcoflowExporter) collect(ch chan<- prometheus.Metric) {
+	ch <- ecoflow.soc
+	ch <- ecoflow.remaintime
+	ch <- ecoflow.wattsinsum
+	ch <- ecoflow.wattsoutsum
+	ch <- ecoflow.checkError
+	ch <- ecoflow.checkRaw
+	ch <- ecoflow.up
+	ch <- ecoflow.duration
+	ch <- ecoflow.lastPoll
+	// a device failing since startup is as stale as the exporter is old
+	since := ecoflow.lastSuccess
+	if since.IsZero() {
+		since = ecoflow.started
+	}
+	ecoflow.staleness.Set(ecoflow.options.Now().Sub(since).Seconds())
+	ch <- ecoflow.staleness
+	if ecoflow.limited() {
+		ecoflow.rateLimited.Set(1)
+	} else {
+		ecoflow.rateLimited.Set(0)
+	}
+	ch <- ecoflow.rateLimited
+	if ecoflow.onlineKnown {
+		ch <- ecoflow.online
+	}
+	ch <- ecoflow.stale
+	ch <- ecoflow.updating
+	ch <- ecoflow.authFailure
+	ch <- ecoflow.socChange
+	ch <- ecoflow.successRatio
+	ch <- ecoflow.availability
+	ch <- ecoflow.scrapes
+	ch <- ecoflow.responsesize
+	ch <- ecoflow.requestsize
+	ch <- ecoflow.account
+	ecoflow.socrange.collect(ch)
+	ecoflow.inrange.collect(ch)
+	ecoflow.outrange.collect(ch)
+	ch <- ecoflow.chargewh
+	ch <- ecoflow.dischargewh
+	model, _ := ecoflow.ecoflow.deviceInfo(ecoflow.data)
+	if model == "" {
+		model = "unknown"
+	}
+	firmware := ecoflow.data.Firmware
+	if firmware == "" {
+		firmware = "unknown"
+	}
+	// the model may come from the API, an invalid one must not panic the scrape
+	device, err := prometheus.NewConstMetric(ecoflow.device, prometheus.GaugeValue, 1, model, firmware, ecoflow.ecoflow.LinkGroup, ecoflow.ecoflow.Alias)
+	if err != nil {
+		device = prometheus.NewInvalidMetric(ecoflow.device, err)
+	}
+	ch <- device
+	// a counter keeps its value while the device fails
+	if ecoflow.generated.known {
+		ch <- prometheus.MustNewConstMetric(ecoflow.generatedWh, prometheus.CounterValue, ecoflow.generated.value())
+	}
+
+	if ecoflow.code != "" {
+		code, err := strconv.ParseFloat(ecoflow.code, 64)
+		if err != nil {
+			code = math.NaN()
+		}
+		metric, err := prometheus.NewConstMetric(ecoflow.apiCode, prometheus.GaugeValue, code, ecoflow.message)
+		if err != nil {
+			metric = prometheus.NewInvalidMetric(ecoflow.apiCode, err)
+		}
+		ch <- metric
+	}
+
+	// the data metrics are only reported while the last poll was successful and
+	// the device is online
+	if !ecoflow.ok || ecoflow.offline {
+		return
+	}
+
+	// remain_energy_wh is only known when the capacity comes from the API or config
+	if _, capacity := ecoflow.ecoflow.deviceInfo(ecoflow.data); capacity > 0 {
+		ecoflow.remainenergy.Set(ecoflow.data.Soc / 100 * capacity)
+		ch <- ecoflow.remainenergy
+	}
+
+	meters := ecoflow.options.Models.metersOf(model)
+	collectChannels(ch, ecoflow.wattsIn, meters.wattsIn, ecoflow.quotaData)
+	collectChannels(ch, ecoflow.wattsOut, meters.wattsOut, ecoflow.quotaData)
+	collectMeters(ch, ecoflow.inputVolts, meters.inputVolts, ecoflow.quotaData)
+	collectMeters(ch, ecoflow.outputVolts, meters.outputVolts, ecoflow.quotaData)
+	collectMeters(ch, ecoflow.inputAmps, meters.inputAmps, ecoflow.quotaData)
+	collectMeters(ch, ecoflow.outputAmps, meters.outputAmps, ecoflow.quotaData)
+	collectMeters(ch, ecoflow.solarWatts, meters.solarWatts, ecoflow.quotaData)
+	collectMeters(ch, ecoflow.solarVolts, meters.solarVolts, ecoflow.quotaData)
+	collectMeters(ch, ecoflow.solarAmps, meters.solarAmps, ecoflow.quotaData)
+	collectTarget(ch, ecoflow.acTargetVolt, meters.acTargetVolts, ecoflow.quotaData)
+	collectTarget(ch, ecoflow.acTargetFreq, meters.acTargetFrequency, ecoflow.quotaData)
+	if efficiency, ok := solarChargeEfficiency(ecoflow.quotaData, meters); ok {
+		ch <- prometheus.MustNewConstMetric(ecoflow.solarCharge, prometheus.GaugeValue, efficiency)
+	}
+	collectSwitches(ch, ecoflow.outputOn, meters.outputSwitches, ecoflow.quotaData)
+	collectBatteries(ch, ecoflow.batteryTemp, ecoflow.cycles, ecoflow.quotaData)
+	collectRemainTimes(ch, ecoflow.timeToFull, ecoflow.timeToEmpty, ecoflow.quotaData, ecoflow.data)
+
+	for _, metric := range ecoflow.derived {
+		metric.collect(ch, ecoflow.ecoflow, ecoflow.data)
+	}
+	for i := range ecoflow.quota {
+		ecoflow.quota[i].collect(ch)
+	}
+}
+
+// fetch queries the API, or takes the next recorded response in replay mode
+func (ecoflow *EcoflowExporter) fetch(ctx context.Context) (EcoflowApi, error) {
+	if ecoflow.options.Replay != nil {
+		res, err := decodeEcoflowApi(ecoflow.ecoflow, ecoflow.options.Replay.next(ecoflow.ecoflow.SerialNumber))
+		res.StatusCode = http.StatusOK
+		return res, err
+	}
+	return getEcoflowApiData(ctx, ecoflow.ecoflow, ecoflow.options)
+}
+
+// authCodes are the API codes rejecting the credentials. The API answers them
+// with HTTP 200.
+var authCodes = map[responseCode]bool{
+	"8513": true, // invalid appKey
+	"8521": true, // wrong signature, i.e. wrong secretKey
+}
+
+// authFailed tells if the API rejected the credentials, by HTTP status or by
+// API code
+func authFailed(res EcoflowApi, err error) bool {
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return true
+	}
+	return err == nil && authCodes[res.Code]
+}
+
+// updateAuthFailure tracks since when the credentials are rejected. The API
+// gives no expiry hint, so the onset of 401/403 responses and of the authCodes
+// is the only signal; any other failure leaves the state as it is.
+func (ecoflow *EcoflowExporter) updateAuthFailure(res EcoflowApi, err error) {
+	now := ecoflow.options.Now()
+	switch {
+	case authFailed(res, err):
+		if ecoflow.authSince.IsZero() {
+			ecoflow.authSince = now
+		}
+	case err == nil && "0" == res.Code:
+		ecoflow.authSince = time.Time{}
+	}
+
+	if ecoflow.authSince.IsZero() {
+		ecoflow.authFailure.Set(0)
+	} else {
+		ecoflow.authFailure.Set(now.Sub(ecoflow.authSince).Seconds())
+	}
+}
+
+// setCheckResult updates the raw and the debounced check_error gauges
+func (ecoflow *EcoflowExporter) setCheckResult(ok bool) {
+	ecoflow.ok = ok
+	if ok {
+		ecoflow.checkRaw.Set(0)
+		ecoflow.up.Set(1)
+	} else {
+		ecoflow.checkRaw.Set(1)
+		ecoflow.up.Set(0)
+	}
+
+	ecoflow.successes.add(ok)
+	ecoflow.successRatio.Set(ecoflow.successes.ratio())
+
+	// the first scrape seeds the average
+	result := 0.0
+	if ok {
+		result = 1
+	}
+	if ecoflow.scraped {
+		ecoflow.available += ecoflow.options.AvailabilityDecay * (result - ecoflow.available)
+	} else {
+		ecoflow.available = result
+		ecoflow.scraped = true
+	}
+	ecoflow.availability.Set(ecoflow.available)
+
+	if ecoflow.errorState.update(ok, ecoflow.options.Now()) {
+		ecoflow.checkError.Set(1)
+	} else {
+		ecoflow.checkError.Set(0)
+	}
+}
+
+// statusAcceptable tells if an HTTP status counts as success, any 2xx when no
+// statuses are configured
+func statusAcceptable(statusCode int, acceptable []int) bool {
+	if len(acceptable) == 0 {
+		return statusCode >= 200 && statusCode < 300
+	}
+	for _, code := range acceptable {
+		if statusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+func getEcoflowApiData(ctx context.Context, ecoflow *Ecoflow, options ExporterOptions) (EcoflowApi, error) {
+	apiUrl := *options.ApiUrl
+	query := apiUrl.Query()
+	query.Set("sn", ecoflow.SerialNumber)
+	apiUrl.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, options.CheckTimeout)
+	defer cancel()
+
+	// waiting for a free slot counts against the check timeout
+	if options.Semaphore != nil {
+		waiting := time.Now()
+		if err := waitScrapeTurn(ctx, ecoflow.SerialNumber); err != nil {
+			scrapeSlotWait.WithLabelValues(ecoflow.SerialNumber).Observe(time.Since(waiting).Seconds())
+			return EcoflowApi{}, err
+		}
+		select {
+		case options.Semaphore <- struct{}{}:
+		default:
+			// every slot is taken, the exporter throttles itself
+			rateLimitWaits.WithLabelValues("slot").Inc()
+			select {
+			case options.Semaphore <- struct{}{}:
+			case <-ctx.Done():
+				scrapeSlotWait.WithLabelValues(ecoflow.SerialNumber).Observe(time.Since(waiting).Seconds())
+				return EcoflowApi{}, ctx.Err()
+			}
+		}
+		passScrapeTurn(ctx, ecoflow.SerialNumber)
+		scrapeSlotWait.WithLabelValues(ecoflow.SerialNumber).Observe(time.Since(waiting).Seconds())
+		defer func() { <-options.Semaphore }()
+	}
+	concurrentScrapes.Inc()
+	defer concurrentScrapes.Dec()
+
+	start := time.Now()
+	res, err := retryEcoflowApi(ctx, apiUrl.String(), ecoflow, options)
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	} else if "0" != res.Code {
+		outcome = "api_error"
+	}
+	apiRequestDuration.WithLabelValues(ecoflow.SerialNumber, outcome).Observe(time.Since(start).Seconds())
+	return res, err
+}
+
+// retryEcoflowApi requests the quota, retrying transient failures
+func retryEcoflowApi(ctx context.Context, apiUrl string, ecoflow *Ecoflow, options ExporterOptions) (EcoflowApi, error) {
+	for attempt := 0; ; attempt++ {
+		res, retry, err := attemptEcoflowApi(ctx, attempt, apiUrl, ecoflow, options)
+		if err == nil || !retry || attempt >= options.MaxRetries {
+			return res, err
+		}
+		// in a wide outage the devices fail without retrying
+		if !options.RetryBudget.take() {
+			retriesSkipped.Inc()
+			return res, err
+		}
+
+		// retries never run past the check timeout
+		wait := options.RetryBackoff << attempt
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return res, err
+		}
+		select {
+		case <-ctx.Done():
+			return res, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// attemptEcoflowApi makes the request of the attempt, limited by its attempt
+// timeout. Running out of it is retryable as long as ctx isn't done.
+func attemptEcoflowApi(ctx context.Context, attempt int, apiUrl string, ecoflow *Ecoflow, options ExporterOptions) (EcoflowApi, bool, error) {
+	timeout := attemptTimeout(attempt, options)
+	if timeout <= 0 {
+		return requestEcoflowApi(ctx, apiUrl, ecoflow, options)
+	}
+	// the deadline of ctx wins if it's earlier
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	res, retry, err := requestEcoflowApi(attemptCtx, apiUrl, ecoflow, options)
+	if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		return res, true, fmt.Errorf("attempt timeout of %s exceeded: %w", timeout, err)
+	}
+	return res, retry, err
+}
+
+// attemptTimeout returns the timeout of the attempt, 0 for none
+func attemptTimeout(attempt int, options ExporterOptions) time.Duration {
+	if options.AttemptTimeout <= 0 {
+		return 0
+	}
+	multiplier := options.AttemptTimeoutMultiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	return time.Duration(float64(options.AttemptTimeout) * math.Pow(multiplier, float64(attempt)))
+}
+
+// proxyFunc sends all requests through proxyUrl except the ones excluded by
+// NO_PROXY
+func proxyFunc(proxyUrl string) func(*http.Request) (*url.URL, error) {
+	config := httpproxy.FromEnvironment()
+	config.HTTPProxy = proxyUrl
+	config.HTTPSProxy = proxyUrl
+	proxy := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// newApiTransport creates the transport of the API client, with the proxy and
+// the client certificate if given
+func newApiTransport(proxyUrl, clientCert, clientKey string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 16
+	// the default transport already uses HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	if proxyUrl != "" {
+		transport.Proxy = proxyFunc(proxyUrl)
+	}
+	if clientCert != "" || clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	return transport, nil
+}
+
+// newServerTLSConfig returns the TLS config of the metrics server requiring
+// client certificates signed by the CA, nil without a CA
+func newServerTLSConfig(clientCaFile string) (*tls.Config, error) {
+	if clientCaFile == "" {
+		return nil, nil
+	}
+	ca, err := os.ReadFile(clientCaFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates found")
+	}
+	return &tls.Config{
+		ClientCAs:  clientCAs,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// serve serves HTTPS if a certificate is given, plain HTTP otherwise
+func serve(server *http.Server, listener net.Listener, certFile, keyFile string) error {
+	if certFile != "" {
+		return server.ServeTLS(listener, certFile, keyFile)
+	}
+	return server.Serve(listener)
+}
+
+// newEcoflowRequest creates an API request authenticated with the device keys, a
+// POST if there is a body
+func newEcoflowRequest(ctx context.Context, apiUrl string, body []byte, ecoflow *Ecoflow, options ExporterOptions) (*http.Request, error) {
+	method := http.MethodGet
+	var reader io.Reader
+	if body != nil {
+		method = http.MethodPost
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiUrl, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", options.UserAgent)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("appKey", ecoflow.AppKey)
+	req.Header.Set("secretKey", ecoflow.SecretKey)
+	return req, nil
+}
+
+// getEcoflowBody makes a single request to one of the other API endpoints and
+// returns the response body. Signed requests carry an HMAC signature instead
+// of the plain keys, as the iot-open endpoints require.
+func getEcoflowBody(apiUrl string, signed bool, ecoflow *Ecoflow, options ExporterOptions) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), options.CheckTimeout)
+	defer cancel()
+
+	req, err := newEcoflowRequest(ctx, apiUrl, nil, ecoflow, options)
+	if err != nil {
+		return nil, err
+	}
+	if signed {
+		req.Header.Del("appKey")
+		req.Header.Del("secretKey")
+		signEcoflowRequest(req, ecoflow, time.Now())
+	}
+
+	res, err := options.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if !statusAcceptable(res.StatusCode, options.AcceptableStatus) {
+		return nil, fmt.Errorf("unexpected HTTP status %d", res.StatusCode)
+	}
+	return readBody(res.Body, options.MaxResponseBytes)
+}
+
+// errResponseTooLarge is returned for bodies over --max-response-bytes
+var errResponseTooLarge = errors.New("response too large")
+
+// readBody reads the body up to limit bytes, a larger one is an error rather
+// than silently truncated. 0 is no limit.
+func readBody(body io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(body)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", errResponseTooLarge, limit)
+	}
+	return data, nil
+}
+
+// requestEcoflowApi makes a single API request. Failures are retryable when
+// they are likely transient: network errors and 5xx responses. 4xx responses
+// and API codes come back the same on every try.
+func requestEcoflowApi(ctx context.Context, apiUrl string, ecoflow *Ecoflow, options ExporterOptions) (EcoflowApi, bool, error) {
+	body, err := ecoflow.quotaRequestBody()
+	if err != nil {
+		return EcoflowApi{}, false, err
+	}
+	req, err := newEcoflowRequest(ctx, apiUrl, body, ecoflow, options)
+	if err != nil {
+		return EcoflowApi{}, false, err
+	}
+	requestBytes := len(body)
+
+	res, getErr := options.Client.Do(req)
+	if getErr != nil {
+		return EcoflowApi{RequestBytes: requestBytes}, ctx.Err() == nil, getErr
+	}
+
+	// the body is fully read below, a close error can't affect the result
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		retryAfter := parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		return EcoflowApi{StatusCode: res.StatusCode, RetryAfter: retryAfter, RequestBytes: requestBytes}, false, fmt.Errorf("rate limited by the API for %s", retryAfter)
+	}
+
+	// the API code is checked by the caller, the status only has to be acceptable
+	if !statusAcceptable(res.StatusCode, options.AcceptableStatus) {
+		return EcoflowApi{StatusCode: res.StatusCode, RequestBytes: requestBytes}, res.StatusCode >= 500, fmt.Errorf("unexpected HTTP status %d", res.StatusCode)
+	}
+
+	body, readErr := readBody(res.Body, options.MaxResponseBytes)
+	if readErr != nil {
+		return EcoflowApi{StatusCode: res.StatusCode, RequestBytes: requestBytes}, ctx.Err() == nil && !errors.Is(readErr, errResponseTooLarge), readErr
+	}
+
+	ecoflowData, jsonErr := decodeEcoflowApi(ecoflow, body)
+	ecoflowData.StatusCode = res.StatusCode
+	ecoflowData.RequestBytes = requestBytes
+	return ecoflowData, false, jsonErr
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP
+// date, a missing or broken one means defaultRetryAfter
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
+// decodeEcoflowApi decodes a queryDeviceQuota response body
+func decodeEcoflowApi(ecoflow *Ecoflow, body []byte) (EcoflowApi, error) {
+	var ecoflowData EcoflowApi
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	jsonErr := decoder.Decode(&ecoflowData)
+	if jsonErr != nil {
+		return EcoflowApi{ResponseBytes: len(body), Body: body}, jsonErr
+	}
+
+	// some proxies append data after the object, the decoded object is still good
+	if _, err := decoder.Token(); err != io.EOF {
+		slog.Warn("Ignoring trailing data in API response", "sn", ecoflow.SerialNumber)
+	}
+	ecoflowData.ResponseBytes = len(body)
+	ecoflowData.Body = body
+
+	return ecoflowData, nil
+}
+
+// checkConfig loads the config and queries every device once, printing the
+// results as a table. It returns the exit code, 1 when anything failed.
+func checkConfig(configFile string, options ExporterOptions, out io.Writer) int {
+	ecoflowConfig, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Fprintf(out, "FAIL %s\n", err)
+		return 1
+	}
+	options.CommonLabels = ecoflowConfig.CommonLabels
+	options.Models = ecoflowConfig.models
+
+	// the devices of the accounts that could be listed are still checked
+	ecoflowList, discoveryErr := discoverDevices(ecoflowConfig.Devices, options)
+	if discoveryErr != nil {
+		fmt.Fprintf(out, "FAIL %s\n", discoveryErr)
+	}
+
+	failed := 0
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "RESULT\tSN\tDESCRIPTION\tCODE\tMESSAGE")
+	for _, ecoflow := range ecoflowList {
+		result := "PASS"
+		res, err := getEcoflowApiData(context.Background(), &ecoflow, ecoflow.exporterOptions(options))
+		message := res.Message
+		if err != nil {
+			message = err.Error()
+		}
+		if err != nil || "0" != res.Code {
+			result = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", result, ecoflow.SerialNumber, ecoflow.Description, res.Code, message)
+	}
+	table.Flush()
+
+	if failed > 0 {
+		fmt.Fprintf(out, "%d of %d devices failed\n", failed, len(ecoflowList))
+		return 1
+	}
+	if discoveryErr != nil {
+		return 1
+	}
+	return 0
+}
+
+// preflight queries every device once and returns the number of healthy ones
+func preflight(ecoflowList []Ecoflow, options ExporterOptions) int {
+	healthy := 0
+	for _, ecoflow := range ecoflowList {
+		res, err := getEcoflowApiData(context.Background(), &ecoflow, ecoflow.exporterOptions(options))
+		if err != nil {
+			slog.Warn("Preflight failed", "sn", ecoflow.SerialNumber, "error", err)
+			continue
+		}
+		if "0" != res.Code {
+			slog.Warn("Preflight failed", "sn", ecoflow.SerialNumber, "code", res.Code, "message", res.Message)
+			continue
+		}
+		healthy++
+	}
+	return healthy
+}
+
+// parseListenAddr returns the network and address of --listen: unix and the
+// path for unix:/path, tcp and host:port otherwise. host may be empty, a name,
+// an IPv4 or a bracketed IPv6 address, a bare port listens on all interfaces.
+func parseListenAddr(listen string) (string, string, error) {
+	if strings.HasPrefix(listen, "unix:") {
+		path := strings.TrimPrefix(listen, "unix:")
+		if path == "" {
+			return "", "", errors.New("missing socket path after unix:")
+		}
+		return "unix", path, nil
+	}
+
+	if _, err := strconv.Atoi(listen); err == nil {
+		listen = ":" + listen
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", "", err
+	}
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", "", fmt.Errorf("invalid IPv6 address %q", host)
+	}
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 1 || number > 65535 {
+		return "", "", fmt.Errorf("invalid port %q", port)
+	}
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
+// newListener listens on an address returned by parseListenAddr. Closing a
+// unix listener removes the socket file.
+func newListener(network, address string) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	// a stale socket from a previous run would make Listen fail
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", address)
+}
+
+// newLogger creates the logger for --log-level and --log-format
+func newLogger(level, format string) (*slog.Logger, error) {
+	var options slog.HandlerOptions
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	options.Level = logLevel
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, &options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, &options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// fatal logs a startup error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// startup loads the config, runs the preflight and registers the device exporters
+func startup(ctx context.Context, configFile string, options ExporterOptions, requireOneHealthy bool, devices *exporterSet) error {
+	ecoflowConfig, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	options.CommonLabels = ecoflowConfig.CommonLabels
+	options.Models = ecoflowConfig.models
+
+	// devices of the accounts that could be listed are still started, the
+	// failures are logged by discoverDevices
+	ecoflowList, err := discoverDevices(ecoflowConfig.Devices, options)
+	if err != nil && len(ecoflowList) == 0 {
+		return err
+	}
+
+	if requireOneHealthy && preflight(ecoflowList, options) == 0 {
+		return errors.New("preflight failed: no healthy devices")
+	}
+
+	return devices.update(ctx, ecoflowList, options)
+}
+
+// awaitStartup runs start and waits for it up to timeout, 0 waits as long as it
+// takes. The returned channel is closed once start succeeded. In degraded mode
+// a start running past the timeout is left to finish in the background and its
+// failure is logged, it no longer stops the exporter.
+func awaitStartup(timeout time.Duration, degraded bool, start func() error) (<-chan struct{}, error) {
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- start()
+	}()
+
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+		close(started)
+		return started, nil
+	case <-timedOut:
+	}
+
+	if !degraded {
+		return nil, fmt.Errorf("did not finish within %s", timeout)
+	}
+	slog.Warn("Startup did not finish in time, serving in degraded mode", "timeout", timeout)
+	go func() {
+		if err := <-done; err != nil {
+			slog.Error("Startup failed, serving in degraded mode", "error", err)
+			return
+		}
+		slog.Info("Startup finished, leaving degraded mode")
+		close(started)
+	}()
+	return started, nil
+}
+
+// reload applies a changed config file. The running config is kept when the
+// new one is broken.
+func reload(ctx context.Context, configFile string, options ExporterOptions, devices *exporterSet) {
+	ecoflowConfig, err := loadConfig(configFile)
+	var ecoflowList []Ecoflow
+	if err == nil {
+		options.CommonLabels = ecoflowConfig.CommonLabels
+		options.Models = ecoflowConfig.models
+		ecoflowList, err = discoverDevices(ecoflowConfig.Devices, options)
+	}
+	if err != nil {
+		slog.Error("Couldn't reload config, keeping the running one", "error", err)
+		return
+	}
+	if err := devices.update(ctx, ecoflowList, options); err != nil {
+		slog.Error("Reloaded config, but no device is running", "error", err)
+		return
+	}
+	slog.Info("Reloaded config", "devices", len(ecoflowList))
+}
+
+func main() {
+
+	var listen string
+	listenDefault := "0.0.0.0:9136"
+	pflag.StringVar(&listen, "listen", listenDefault, "Listen address: host:port, :port, [ipv6]:port, or unix:/path/to/socket. Env LISTEN also can be used.")
+
+	var configFile string
+	configFileDefault := "/etc/prometheus/prometheus-ecoflow-exporter.yaml"
+	pflag.StringVar(&configFile, "config-file", configFileDefault, "Config file, or a directory whose *.yaml and *.yml files are merged")
+
+	var metricsPath string
+	metricsPathDefault := "/metrics"
+	pflag.StringVar(&metricsPath, "metrics-path", metricsPathDefault, "Metrics path")
+
+	var apiUrl string
+	apiUrlDefault := "https://api.ecoflow.com/iot-service/open/api/device/queryDeviceQuota"
+	pflag.StringVar(&apiUrl, "api-url", apiUrlDefault, "EcoFlow queryDeviceQuota API URL. Env API_URL also can be used.")
+
+	var deviceListUrl string
+	deviceListUrlDefault := "https://api.ecoflow.com/iot-service/open/api/device/list"
+	pflag.StringVar(&deviceListUrl, "device-list-url", deviceListUrlDefault, "EcoFlow device list API URL, used to discover the devices of config entries without serialNumber. Env DEVICE_LIST_URL also can be used.")
+
+	var mqttCertificationUrl string
+	mqttCertificationUrlDefault := "https://api.ecoflow.com/iot-open/sign/certification"
+	pflag.StringVar(&mqttCertificationUrl, "mqtt-certification-url", mqttCertificationUrlDefault, "EcoFlow MQTT certification API URL, used by devices with transport mqtt. Env MQTT_CERTIFICATION_URL also can be used.")
+
+	var checkTimeout time.Duration
+	checkTimeoutDefault := 5 * time.Second
+	pflag.DurationVar(&checkTimeout, "check-timeout", checkTimeoutDefault, "Check timeout. Env CHECK_TIMEOUT also can be used.")
+	// check_timeout is the old name, kept working for existing setups
+	pflag.DurationVar(&checkTimeout, "check_timeout", checkTimeoutDefault, "Check timeout")
+	pflag.CommandLine.MarkDeprecated("check_timeout", "use --check-timeout instead")
+
+	var proxyUrl string
+	proxyUrlDefault := ""
+	pflag.StringVar(&proxyUrl, "proxy-url", proxyUrlDefault, "Proxy for the EcoFlow API requests, instead of HTTP_PROXY/HTTPS_PROXY. NO_PROXY is still respected. Env PROXY_URL also can be used.")
+
+	var apiClientCert string
+	apiClientCertDefault := ""
+	pflag.StringVar(&apiClientCert, "api-client-cert", apiClientCertDefault, "Client certificate file for the EcoFlow API (mTLS). Env API_CLIENT_CERT also can be used.")
+
+	var apiClientKey string
+	apiClientKeyDefault := ""
+	pflag.StringVar(&apiClientKey, "api-client-key", apiClientKeyDefault, "Client certificate key file for the EcoFlow API (mTLS). Env API_CLIENT_KEY also can be used.")
+
+	var requireOneHealthy bool
+	requireOneHealthyDefault := false
+	pflag.BoolVar(&requireOneHealthy, "require-one-healthy", requireOneHealthyDefault, "Query all devices at startup and exit if none of them is healthy. Env REQUIRE_ONE_HEALTHY also can be used.")
+
+	var errorThreshold int
+	errorThresholdDefault := 1
+	pflag.IntVar(&errorThreshold, "error-threshold", errorThresholdDefault, "Consecutive failed scrapes before check_error is set. Env ERROR_THRESHOLD also can be used.")
+
+	var recoverThreshold int
+	recoverThresholdDefault := 1
+	pflag.IntVar(&recoverThreshold, "recover-threshold", recoverThresholdDefault, "Consecutive successful scrapes before check_error is cleared. Env RECOVER_THRESHOLD also can be used.")
+
+	var errorMinHold time.Duration
+	errorMinHoldDefault := time.Duration(0)
+	pflag.DurationVar(&errorMinHold, "error-min-hold", errorMinHoldDefault, "Minimum time check_error keeps its value after a change. Env ERROR_MIN_HOLD also can be used.")
+
+	var staleOnError bool
+	staleOnErrorDefault := true
+	pflag.BoolVar(&staleOnError, "stale-on-error", staleOnErrorDefault, "Report soc, remain_time and the watts sums as NaN while the device fails instead of the last values. A 429 response keeps the last values. Env STALE_ON_ERROR also can be used.")
+
+	var staleWhileUpdating bool
+	staleWhileUpdatingDefault := false
+	pflag.BoolVar(&staleWhileUpdating, "stale-while-updating", staleWhileUpdatingDefault, "Report soc, remain_time and the watts sums as NaN while the device installs a firmware update. Env STALE_WHILE_UPDATING also can be used.")
+
+	var enableDebugEndpoint bool
+	enableDebugEndpointDefault := false
+	pflag.BoolVar(&enableDebugEndpoint, "enable-debug-endpoint", enableDebugEndpointDefault, "Serve the last raw API response of every device on /debug/devices/<sn>. Responses may contain identifying information. Env ENABLE_DEBUG_ENDPOINT also can be used.")
+
+	var disableOpenMetrics bool
+	disableOpenMetricsDefault := false
+	pflag.BoolVar(&disableOpenMetrics, "disable-openmetrics", disableOpenMetricsDefault, "Always serve the Prometheus text format, even to scrapers asking for OpenMetrics. Env DISABLE_OPENMETRICS also can be used.")
+
+	var historySize int
+	historySizeDefault := 0
+	pflag.IntVar(&historySize, "history-size", historySizeDefault, "Number of recent scrapes per device served on /debug/history?sn=, 0 disables it. Env HISTORY_SIZE also can be used.")
+
+	var successWindow int
+	successWindowDefault := 10
+	pflag.IntVar(&successWindow, "success-window", successWindowDefault, "Number of recent scrapes ecoflow_scrape_success_ratio is computed over. Env SUCCESS_WINDOW also can be used.")
+
+	var startupTimeout time.Duration
+	startupTimeoutDefault := time.Duration(0)
+	pflag.DurationVar(&startupTimeout, "startup-timeout", startupTimeoutDefault, "Deadline for loading the config, preflight and registering devices, 0 disables it. Env STARTUP_TIMEOUT also can be used.")
+
+	var startupDegraded bool
+	startupDegradedDefault := false
+	pflag.BoolVar(&startupDegraded, "startup-degraded", startupDegradedDefault, "Start serving in degraded mode instead of exiting when --startup-timeout is hit. Env STARTUP_DEGRADED also can be used.")
+
+	var availabilityDecay float64
+	availabilityDecayDefault := 0.05
+	pflag.Float64Var(&availabilityDecay, "availability-decay", availabilityDecayDefault, "Weight (0-1] of the latest scrape in ecoflow_availability, smaller is smoother. Env AVAILABILITY_DECAY also can be used.")
+
+	var staleTelemetryPolls int
+	staleTelemetryPollsDefault := 0
+	pflag.IntVar(&staleTelemetryPolls, "stale-telemetry-polls", staleTelemetryPollsDefault, "Identical responses in a row after which ecoflow_telemetry_stale is set, counting the first one, so at least 2. 0 disables it. Env STALE_TELEMETRY_POLLS also can be used.")
+
+	var perDeviceRegistry bool
+	perDeviceRegistryDefault := false
+	pflag.BoolVar(&perDeviceRegistry, "per-device-registry", perDeviceRegistryDefault, "Put every device on its own registry, also served on <metrics-path>/<sn>. Env PER_DEVICE_REGISTRY also can be used.")
+
+	var healthInterval time.Duration
+	healthIntervalDefault := time.Duration(0)
+	pflag.DurationVar(&healthInterval, "device-health-interval", healthIntervalDefault, "Interval of the device checks served on /healthz/devices, 0 disables them. Env DEVICE_HEALTH_INTERVAL also can be used.")
+
+	var healthTimeout time.Duration
+	healthTimeoutDefault := 2 * time.Second
+	pflag.DurationVar(&healthTimeout, "device-health-timeout", healthTimeoutDefault, "Timeout of a device check. Env DEVICE_HEALTH_TIMEOUT also can be used.")
+
+	var replayFile string
+	replayFileDefault := ""
+	pflag.StringVar(&replayFile, "replay-file", replayFileDefault, "Serve recorded API responses from this file (one JSON response per line, cycled) instead of calling the API. Env REPLAY_FILE also can be used.")
+
+	var acceptableStatus []int
+	pflag.IntSliceVar(&acceptableStatus, "acceptable-status", nil, "HTTP statuses of the API counted as success (default any 2xx), the API code still has to be 0. Env ACCEPTABLE_STATUS also can be used.")
+
+	var discoveryConcurrency int
+	discoveryConcurrencyDefault := 4
+	pflag.IntVar(&discoveryConcurrency, "discovery-concurrency", discoveryConcurrencyDefault, "Maximum device list requests in flight while discovering devices, 0 is unlimited. Env DISCOVERY_CONCURRENCY also can be used.")
+
+	var maxConcurrent int
+	maxConcurrentDefault := 0
+	pflag.IntVar(&maxConcurrent, "max-concurrent-scrapes", maxConcurrentDefault, "Maximum API requests in flight across all devices, 0 is unlimited. Env MAX_CONCURRENT_SCRAPES also can be used.")
+
+	var pollInterval time.Duration
+	pollIntervalDefault := time.Duration(0)
+	pflag.DurationVar(&pollInterval, "poll-interval", pollIntervalDefault, "Poll devices in the background on this interval and serve the last values, 0 polls on every scrape. Env POLL_INTERVAL also can be used.")
+
+	var minScrapeInterval time.Duration
+	minScrapeIntervalDefault := time.Duration(0)
+	pflag.DurationVar(&minScrapeInterval, "min-scrape-interval", minScrapeIntervalDefault, "Serve the last successful result to scrapes within this interval instead of requesting the device again, without --poll-interval. Env MIN_SCRAPE_INTERVAL also can be used.")
+
+	var pollJitter time.Duration
+	pollJitterDefault := time.Duration(0)
+	pflag.DurationVar(&pollJitter, "poll-jitter", pollJitterDefault, "Delay the first background poll of every device by a random offset up to this, at most --poll-interval. Env POLL_JITTER also can be used.")
+
+	var pollJitterSeed int64
+	pollJitterSeedDefault := int64(0)
+	pflag.Int64Var(&pollJitterSeed, "poll-jitter-seed", pollJitterSeedDefault, "Derive the --poll-jitter offsets from this seed and the serial numbers instead of randomly, 0 is random. Env POLL_JITTER_SEED also can be used.")
+
+	var maxResponseBytes int64
+	maxResponseBytesDefault := int64(1 << 20)
+	pflag.Int64Var(&maxResponseBytes, "max-response-bytes", maxResponseBytesDefault, "Largest API response accepted, larger ones fail the scrape, 0 is no limit. Env MAX_RESPONSE_BYTES also can be used.")
+
+	var maxRetries int
+	maxRetriesDefault := 0
+	pflag.IntVar(&maxRetries, "max-retries", maxRetriesDefault, "Retries of API network errors and 5xx responses within --check-timeout. Env MAX_RETRIES also can be used.")
+
+	var retryBackoff time.Duration
+	retryBackoffDefault := 200 * time.Millisecond
+	pflag.DurationVar(&retryBackoff, "retry-backoff", retryBackoffDefault, "Wait before the first retry, doubled on every further one. Env RETRY_BACKOFF also can be used.")
+
+	var retryBudgetPerMinute int
+	retryBudgetPerMinuteDefault := 0
+	pflag.IntVar(&retryBudgetPerMinute, "retry-budget", retryBudgetPerMinuteDefault, "Retries per minute of all devices together, failing scrapes beyond it aren't retried. 0 is unlimited. Env RETRY_BUDGET also can be used.")
+
+	var attemptTimeout time.Duration
+	attemptTimeoutDefault := time.Duration(0)
+	pflag.DurationVar(&attemptTimeout, "attempt-timeout", attemptTimeoutDefault, "Timeout of the first API request of a scrape, retries get --attempt-timeout-multiplier times more each, all within --check-timeout. 0 only limits them by --check-timeout. Env ATTEMPT_TIMEOUT also can be used.")
+
+	var attemptTimeoutMultiplier float64
+	attemptTimeoutMultiplierDefault := 2.0
+	pflag.Float64Var(&attemptTimeoutMultiplier, "attempt-timeout-multiplier", attemptTimeoutMultiplierDefault, "Growth of the attempt timeout on every retry, at least 1. Env ATTEMPT_TIMEOUT_MULTIPLIER also can be used.")
+
+	var tlsCertFile string
+	tlsCertFileDefault := ""
+	pflag.StringVar(&tlsCertFile, "tls-cert-file", tlsCertFileDefault, "Certificate file to serve HTTPS, plain HTTP if not set. Env TLS_CERT_FILE also can be used.")
+
+	var tlsKeyFile string
+	tlsKeyFileDefault := ""
+	pflag.StringVar(&tlsKeyFile, "tls-key-file", tlsKeyFileDefault, "Key file of --tls-cert-file. Env TLS_KEY_FILE also can be used.")
+
+	var tlsClientCaFile string
+	tlsClientCaFileDefault := ""
+	pflag.StringVar(&tlsClientCaFile, "tls-client-ca-file", tlsClientCaFileDefault, "CA file to require and verify client certificates with. Env TLS_CLIENT_CA_FILE also can be used.")
+
+	var apiDurationBuckets []float64
+	apiDurationBucketsDefault := []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	pflag.Float64SliceVar(&apiDurationBuckets, "api-duration-buckets", apiDurationBucketsDefault, "Buckets of ecoflow_api_request_duration_seconds in seconds. Env API_DURATION_BUCKETS also can be used.")
+
+	var shutdownGracePeriod time.Duration
+	shutdownGracePeriodDefault := 10 * time.Second
+	pflag.DurationVar(&shutdownGracePeriod, "shutdown-grace-period", shutdownGracePeriodDefault, "Time given to in-flight scrapes and polls on SIGINT or SIGTERM. Env SHUTDOWN_GRACE_PERIOD also can be used.")
+
+	var userAgent string
+	userAgentDefault := defaultUserAgent()
+	pflag.StringVar(&userAgent, "user-agent", userAgentDefault, "User-Agent of the API requests. Env USER_AGENT also can be used.")
+
+	var showVersion bool
+	pflag.BoolVar(&showVersion, "version", false, "Print the version and exit.")
+
+	var checkOnly bool
+	pflag.BoolVar(&checkOnly, "check-config", false, "Validate the config, query every device once, print the results and exit, non-zero if any device failed.")
+
+	namespaceDefault := namespace
+	pflag.StringVar(&namespace, "metric-namespace", namespaceDefault, "Prefix of all metric names. Env METRIC_NAMESPACE also can be used.")
+
+	var logLevel string
+	logLevelDefault := "info"
+	pflag.StringVar(&logLevel, "log-level", logLevelDefault, "Log level: debug, info, warn or error. Env LOG_LEVEL also can be used.")
+
+	var logFormat string
+	logFormatDefault := "text"
+	pflag.StringVar(&logFormat, "log-format", logFormatDefault, "Log format: text or json. Env LOG_FORMAT also can be used.")
+
+	pflag.Parse()
+
+	if showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
+	if logLevel == logLevelDefault && len(os.Getenv("LOG_LEVEL")) > 0 {
+		logLevel = os.Getenv("LOG_LEVEL")
+	}
+
+	if logFormat == logFormatDefault && len(os.Getenv("LOG_FORMAT")) > 0 {
+		logFormat = os.Getenv("LOG_FORMAT")
+	}
+
+	logger, err := newLogger(logLevel, logFormat)
+	if err != nil {
+		fatal("Invalid logging options", "error", err)
+	}
+	slog.SetDefault(logger)
+
+	if listen == listenDefault && len(os.Getenv("LISTEN")) > 0 {
+		listen = os.Getenv("LISTEN")
+	}
+
+	listenNetwork, listenAddress, err := parseListenAddr(listen)
+	if err != nil {
+		fatal("Invalid listen address", "listen", listen, "error", err)
+	}
+
+	if configFile == configFileDefault && len(os.Getenv("CONFIG_FILE")) > 0 {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
+
+	if metricsPath == metricsPathDefault && len(os.Getenv("METRICS_PATH")) > 0 {
+		metricsPath = os.Getenv("METRICS_PATH")
+	}
+
+	if apiUrl == apiUrlDefault && len(os.Getenv("API_URL")) > 0 {
+		apiUrl = os.Getenv("API_URL")
+	}
+
+	parsedApiUrl, err := url.Parse(apiUrl)
+	if err != nil || !parsedApiUrl.IsAbs() || parsedApiUrl.Host == "" {
+		fatal("Invalid api-url: must be an absolute URL", "api_url", apiUrl)
+	}
+
+	if deviceListUrl == deviceListUrlDefault && len(os.Getenv("DEVICE_LIST_URL")) > 0 {
+		deviceListUrl = os.Getenv("DEVICE_LIST_URL")
+	}
+
+	parsedDeviceListUrl, err := url.Parse(deviceListUrl)
+	if err != nil || !parsedDeviceListUrl.IsAbs() || parsedDeviceListUrl.Host == "" {
+		fatal("Invalid device-list-url: must be an absolute URL", "device_list_url", deviceListUrl)
+	}
+
+	if proxyUrl == proxyUrlDefault && len(os.Getenv("PROXY_URL")) > 0 {
+		proxyUrl = os.Getenv("PROXY_URL")
+	}
+
+	if proxyUrl != "" {
+		parsedProxyUrl, err := url.Parse(proxyUrl)
+		if err != nil || !parsedProxyUrl.IsAbs() || parsedProxyUrl.Host == "" {
+			fatal("Invalid proxy-url: must be an absolute URL", "proxy_url", proxyUrl)
+		}
+	}
+
+	if mqttCertificationUrl == mqttCertificationUrlDefault && len(os.Getenv("MQTT_CERTIFICATION_URL")) > 0 {
+		mqttCertificationUrl = os.Getenv("MQTT_CERTIFICATION_URL")
+	}
+
+	parsedMqttCertificationUrl, err := url.Parse(mqttCertificationUrl)
+	if err != nil || !parsedMqttCertificationUrl.IsAbs() || parsedMqttCertificationUrl.Host == "" {
+		fatal("Invalid mqtt-certification-url: must be an absolute URL", "mqtt_certification_url", mqttCertificationUrl)
+	}
+
+	if checkTimeout == checkTimeoutDefault && len(os.Getenv("CHECK_TIMEOUT")) > 0 {
+		var err error
+		checkTimeout, err = time.ParseDuration(os.Getenv("CHECK_TIMEOUT"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if apiClientCert == apiClientCertDefault && len(os.Getenv("API_CLIENT_CERT")) > 0 {
+		apiClientCert = os.Getenv("API_CLIENT_CERT")
+	}
+
+	if apiClientKey == apiClientKeyDefault && len(os.Getenv("API_CLIENT_KEY")) > 0 {
+		apiClientKey = os.Getenv("API_CLIENT_KEY")
+	}
+
+	if requireOneHealthy == requireOneHealthyDefault && len(os.Getenv("REQUIRE_ONE_HEALTHY")) > 0 {
+		var err error
+		requireOneHealthy, err = strconv.ParseBool(os.Getenv("REQUIRE_ONE_HEALTHY"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if errorThreshold == errorThresholdDefault && len(os.Getenv("ERROR_THRESHOLD")) > 0 {
+		var err error
+		errorThreshold, err = strconv.Atoi(os.Getenv("ERROR_THRESHOLD"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if recoverThreshold == recoverThresholdDefault && len(os.Getenv("RECOVER_THRESHOLD")) > 0 {
+		var err error
+		recoverThreshold, err = strconv.Atoi(os.Getenv("RECOVER_THRESHOLD"))
+		if err != nil {
+			panic(err)
+		}
+	}
+	if errorThreshold < 1 {
+		fatal("Invalid error-threshold: must be at least 1", "error_threshold", errorThreshold)
+	}
+	if recoverThreshold < 1 {
+		fatal("Invalid recover-threshold: must be at least 1", "recover_threshold", recoverThreshold)
+	}
+
+	if errorMinHold == errorMinHoldDefault && len(os.Getenv("ERROR_MIN_HOLD")) > 0 {
+		var err error
+		errorMinHold, err = time.ParseDuration(os.Getenv("ERROR_MIN_HOLD"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if historySize == historySizeDefault && len(os.Getenv("HISTORY_SIZE")) > 0 {
+		var err error
+		historySize, err = strconv.Atoi(os.Getenv("HISTORY_SIZE"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if successWindow == successWindowDefault && len(os.Getenv("SUCCESS_WINDOW")) > 0 {
+		var err error
+		successWindow, err = strconv.Atoi(os.Getenv("SUCCESS_WINDOW"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if successWindow < 1 {
+		fatal("success-window must be at least 1")
+	}
+
+	if startupTimeout == startupTimeoutDefault && len(os.Getenv("STARTUP_TIMEOUT")) > 0 {
+		var err error
+		startupTimeout, err = time.ParseDuration(os.Getenv("STARTUP_TIMEOUT"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if startupDegraded == startupDegradedDefault && len(os.Getenv("STARTUP_DEGRADED")) > 0 {
+		var err error
+		startupDegraded, err = strconv.ParseBool(os.Getenv("STARTUP_DEGRADED"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if availabilityDecay == availabilityDecayDefault && len(os.Getenv("AVAILABILITY_DECAY")) > 0 {
+		var err error
+		availabilityDecay, err = strconv.ParseFloat(os.Getenv("AVAILABILITY_DECAY"), 64)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if availabilityDecay <= 0 || availabilityDecay > 1 {
+		fatal("availability-decay must be in (0, 1]")
+	}
+
+	if staleTelemetryPolls == staleTelemetryPollsDefault && len(os.Getenv("STALE_TELEMETRY_POLLS")) > 0 {
+		var err error
+		staleTelemetryPolls, err = strconv.Atoi(os.Getenv("STALE_TELEMETRY_POLLS"))
+		if err != nil {
+			panic(err)
+		}
+	}
+	// a single response is always identical to itself
+	if staleTelemetryPolls < 0 || staleTelemetryPolls == 1 {
+		fatal("Invalid stale-telemetry-polls: must be 0 or at least 2", "stale_telemetry_polls", staleTelemetryPolls)
+	}
+
+	if disableOpenMetrics == disableOpenMetricsDefault && len(os.Getenv("DISABLE_OPENMETRICS")) > 0 {
+		disableOpenMetrics, err = strconv.ParseBool(os.Getenv("DISABLE_OPENMETRICS"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if enableDebugEndpoint == enableDebugEndpointDefault && len(os.Getenv("ENABLE_DEBUG_ENDPOINT")) > 0 {
+		enableDebugEndpoint, err = strconv.ParseBool(os.Getenv("ENABLE_DEBUG_ENDPOINT"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if staleOnError == staleOnErrorDefault && len(os.Getenv("STALE_ON_ERROR")) > 0 {
+		staleOnError, err = strconv.ParseBool(os.Getenv("STALE_ON_ERROR"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if staleWhileUpdating == staleWhileUpdatingDefault && len(os.Getenv("STALE_WHILE_UPDATING")) > 0 {
+		staleWhileUpdating, err = strconv.ParseBool(os.Getenv("STALE_WHILE_UPDATING"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if perDeviceRegistry == perDeviceRegistryDefault && len(os.Getenv("PER_DEVICE_REGISTRY")) > 0 {
+		var err error
+		perDeviceRegistry, err = strconv.ParseBool(os.Getenv("PER_DEVICE_REGISTRY"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if healthInterval == healthIntervalDefault && len(os.Getenv("DEVICE_HEALTH_INTERVAL")) > 0 {
+		var err error
+		healthInterval, err = time.ParseDuration(os.Getenv("DEVICE_HEALTH_INTERVAL"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if healthTimeout == healthTimeoutDefault && len(os.Getenv("DEVICE_HEALTH_TIMEOUT")) > 0 {
+		var err error
+		healthTimeout, err = time.ParseDuration(os.Getenv("DEVICE_HEALTH_TIMEOUT"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if replayFile == replayFileDefault && len(os.Getenv("REPLAY_FILE")) > 0 {
+		replayFile = os.Getenv("REPLAY_FILE")
+	}
+
+	if len(acceptableStatus) == 0 && len(os.Getenv("ACCEPTABLE_STATUS")) > 0 {
+		for _, status := range strings.Split(os.Getenv("ACCEPTABLE_STATUS"), ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(status))
+			if err != nil {
+				panic(err)
+			}
+			acceptableStatus = append(acceptableStatus, code)
+		}
+	}
+
+	if discoveryConcurrency == discoveryConcurrencyDefault && len(os.Getenv("DISCOVERY_CONCURRENCY")) > 0 {
+		discoveryConcurrency, err = strconv.Atoi(os.Getenv("DISCOVERY_CONCURRENCY"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if maxConcurrent == maxConcurrentDefault && len(os.Getenv("MAX_CONCURRENT_SCRAPES")) > 0 {
+		maxConcurrent, err = strconv.Atoi(os.Getenv("MAX_CONCURRENT_SCRAPES"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if pollInterval == pollIntervalDefault && len(os.Getenv("POLL_INTERVAL")) > 0 {
+		pollInterval, err = time.ParseDuration(os.Getenv("POLL_INTERVAL"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if minScrapeInterval == minScrapeIntervalDefault && len(os.Getenv("MIN_SCRAPE_INTERVAL")) > 0 {
+		minScrapeInterval, err = time.ParseDuration(os.Getenv("MIN_SCRAPE_INTERVAL"))
+		if err != nil {
+			panic(err)
+		}
+	}
+	if minScrapeInterval < 0 {
+		fatal("min-scrape-interval must not be negative")
+	}
+
+	if pollJitter == pollJitterDefault && len(os.Getenv("POLL_JITTER")) > 0 {
+		pollJitter, err = time.ParseDuration(os.Getenv("POLL_JITTER"))
+		if err != nil {
+			panic(err)
+		}
+	}
+	if pollJitter < 0 {
+		fatal("poll-jitter must not be negative")
+	}
+	if pollJitter > pollInterval {
+		pollJitter = pollInterval
+	}
+
+	if pollJitterSeed == pollJitterSeedDefault && len(os.Getenv("POLL_JITTER_SEED")) > 0 {
+		pollJitterSeed, err = strconv.ParseInt(os.Getenv("POLL_JITTER_SEED"), 10, 64)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if maxResponseBytes == maxResponseBytesDefault && len(os.Getenv("MAX_RESPONSE_BYTES")) > 0 {
+		maxResponseBytes, err = strconv.ParseInt(os.Getenv("MAX_RESPONSE_BYTES"), 10, 64)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if maxRetries == maxRetriesDefault && len(os.Getenv("MAX_RETRIES")) > 0 {
+		maxRetries, err = strconv.Atoi(os.Getenv("MAX_RETRIES"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if retryBackoff == retryBackoffDefault && len(os.Getenv("RETRY_BACKOFF")) > 0 {
+		retryBackoff, err = time.ParseDuration(os.Getenv("RETRY_BACKOFF"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if retryBudgetPerMinute == retryBudgetPerMinuteDefault && len(os.Getenv("RETRY_BUDGET")) > 0 {
+		retryBudgetPerMinute, err = strconv.Atoi(os.Getenv("RETRY_BUDGET"))
+		if err != nil {
+			panic(err)
+		}
+	}
+	if retryBudgetPerMinute < 0 {
+		fatal("Invalid retry-budget: must not be negative", "retry_budget", retryBudgetPerMinute)
+	}
+
+	if attemptTimeout == attemptTimeoutDefault && len(os.Getenv("ATTEMPT_TIMEOUT")) > 0 {
+		attemptTimeout, err = time.ParseDuration(os.Getenv("ATTEMPT_TIMEOUT"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if attemptTimeoutMultiplier == attemptTimeoutMultiplierDefault && len(os.Getenv("ATTEMPT_TIMEOUT_MULTIPLIER")) > 0 {
+		attemptTimeoutMultiplier, err = strconv.ParseFloat(os.Getenv("ATTEMPT_TIMEOUT_MULTIPLIER"), 64)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if attemptTimeoutMultiplier < 1 {
+		fatal("Invalid attempt-timeout-multiplier: must be at least 1", "attempt_timeout_multiplier", attemptTimeoutMultiplier)
+	}
+
+	if userAgent == userAgentDefault && len(os.Getenv("USER_AGENT")) > 0 {
+		userAgent = os.Getenv("USER_AGENT")
+	}
+
+	if tlsCertFile == tlsCertFileDefault && len(os.Getenv("TLS_CERT_FILE")) > 0 {
+		tlsCertFile = os.Getenv("TLS_CERT_FILE")
+	}
+
+	if tlsKeyFile == tlsKeyFileDefault && len(os.Getenv("TLS_KEY_FILE")) > 0 {
+		tlsKeyFile = os.Getenv("TLS_KEY_FILE")
+	}
+
+	if tlsClientCaFile == tlsClientCaFileDefault && len(os.Getenv("TLS_CLIENT_CA_FILE")) > 0 {
+		tlsClientCaFile = os.Getenv("TLS_CLIENT_CA_FILE")
+	}
+
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		fatal("tls-cert-file and tls-key-file must be set together")
+	}
+	if tlsClientCaFile != "" && tlsCertFile == "" {
+		fatal("tls-client-ca-file needs tls-cert-file and tls-key-file")
+	}
+
+	if !pflag.CommandLine.Changed("api-duration-buckets") && len(os.Getenv("API_DURATION_BUCKETS")) > 0 {
+		apiDurationBuckets = nil
+		for _, bucket := range strings.Split(os.Getenv("API_DURATION_BUCKETS"), ",") {
+			value, err := strconv.ParseFloat(strings.TrimSpace(bucket), 64)
+			if err != nil {
+				panic(err)
+			}
+			apiDurationBuckets = append(apiDurationBuckets, value)
+		}
+	}
+	if !sort.Float64sAreSorted(apiDurationBuckets) {
+		fatal("api-duration-buckets must be in increasing order")
+	}
+
+	if namespace == namespaceDefault && len(os.Getenv("METRIC_NAMESPACE")) > 0 {
+		namespace = os.Getenv("METRIC_NAMESPACE")
+	}
+	if !model.IsValidMetricName(model.LabelValue(namespace)) {
+		fatal("Invalid metric-namespace: must be a valid metric name", "metric_namespace", namespace)
+	}
+	initMetrics(apiDurationBuckets)
+
+	if shutdownGracePeriod == shutdownGracePeriodDefault && len(os.Getenv("SHUTDOWN_GRACE_PERIOD")) > 0 {
+		shutdownGracePeriod, err = time.ParseDuration(os.Getenv("SHUTDOWN_GRACE_PERIOD"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var semaphore chan struct{}
+	if maxConcurrent > 0 {
+		semaphore = make(chan struct{}, maxConcurrent)
+	}
+	maxConcurrentScrapes.Set(float64(maxConcurrent))
+
+	retryBudget := newRetryBudget(retryBudgetPerMinute, time.Now)
+	if retryBudget != nil {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "retry_budget_tokens",
+			Help:      "Retries left in the --retry-budget of all devices",
+		}, retryBudget.available))
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "rate_limit_budget_used",
+			Help:      "Fraction of the --retry-budget of all devices used up, 0 to 1",
+		}, retryBudget.used))
+	}
+
+	var replayResponses *replay
+	if replayFile != "" {
+		var err error
+		replayResponses, err = loadReplay(replayFile)
+		if err != nil {
+			fatal("Couldn't load replay file", "error", err)
+		}
+	}
+
+	transport, err := newApiTransport(proxyUrl, apiClientCert, apiClientKey)
+	if err != nil {
+		fatal("Couldn't load API client certificate", "error", err)
+	}
+
+	options := ExporterOptions{
+		ApiUrl:                   parsedApiUrl,
+		DeviceListUrl:            parsedDeviceListUrl,
+		MqttCertificationUrl:     parsedMqttCertificationUrl,
+		CheckTimeout:             checkTimeout,
+		Client:                   &http.Client{Transport: transport},
+		UserAgent:                userAgent,
+		MaxResponseBytes:         maxResponseBytes,
+		ErrorThreshold:           errorThreshold,
+		RecoverThreshold:         recoverThreshold,
+		ErrorMinHold:             errorMinHold,
+		HistorySize:              historySize,
+		SuccessWindow:            successWindow,
+		AvailabilityDecay:        availabilityDecay,
+		StaleOnError:             staleOnError,
+		StaleWhileUpdating:       staleWhileUpdating,
+		DebugEndpoint:            enableDebugEndpoint,
+		DiscoveryConcurrency:     discoveryConcurrency,
+		StaleTelemetryPolls:      staleTelemetryPolls,
+		PerDeviceRegistry:        perDeviceRegistry,
+		HealthInterval:           healthInterval,
+		HealthTimeout:            healthTimeout,
+		PollInterval:             pollInterval,
+		MinScrapeInterval:        minScrapeInterval,
+		PollJitter:               pollJitter,
+		PollJitterSeed:           pollJitterSeed,
+		MaxRetries:               maxRetries,
+		RetryBackoff:             retryBackoff,
+		RetryBudget:              retryBudget,
+		AttemptTimeout:           attemptTimeout,
+		AttemptTimeoutMultiplier: attemptTimeoutMultiplier,
+		Replay:                   replayResponses,
+		AcceptableStatus:         acceptableStatus,
+		Semaphore:                semaphore,
+	}
+
+	if checkOnly {
+		os.Exit(checkConfig(configFile, options, os.Stdout))
+	}
+
+	prometheus.MustRegister(concurrentScrapes)
+	prometheus.MustRegister(maxConcurrentScrapes)
+	prometheus.MustRegister(configDevices)
+	prometheus.MustRegister(apiRequestDuration)
+	prometheus.MustRegister(scrapeSlotWait)
+	prometheus.MustRegister(cacheHits)
+	prometheus.MustRegister(retriesSkipped)
+	prometheus.MustRegister(rateLimitWaits)
+	prometheus.MustRegister(buildInfo)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	devices := &exporterSet{}
+	started, err := awaitStartup(startupTimeout, startupDegraded, func() error {
+		return startup(ctx, configFile, options, requireOneHealthy, devices)
+	})
+	if err != nil {
+		fatal("Startup failed", "error", err)
+	}
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		<-started
+		for range reloads {
+			reload(ctx, configFile, options, devices)
+		}
+	}()
+
+	slog.Info("Statring ecoflow exporter", "listen", listen, "version", version, "revision", revision)
+
+	// OpenMetrics is only served to scrapers asking for it
+	handlerOpts := promhttp.HandlerOpts{EnableOpenMetrics: !disableOpenMetrics}
+	http.Handle(metricsPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		metricsHandler(devices, handlerOpts),
+	))
+	if metricsPath != "/" {
+		http.Handle("/", landingHandler(metricsPath))
+	}
+	if prefix := strings.TrimSuffix(metricsPath, "/") + "/"; perDeviceRegistry && prefix != metricsPath {
+		http.Handle(prefix, deviceMetricsHandler(devices, prefix, handlerOpts))
+	}
+	if historySize > 0 {
+		http.Handle("/debug/history", historyHandler(devices))
+	}
+	if enableDebugEndpoint {
+		http.Handle("/debug/devices/", debugHandler(devices, "/debug/devices/"))
+	}
+	http.HandleFunc("/healthz", livenessHandler)
+	http.Handle("/ready", readinessHandler(started))
+	if healthInterval > 0 {
+		http.Handle("/healthz/devices", healthHandler(devices))
+	}
 
-	http.Handle(metricsPath, promhttp.Handler())
-	err = http.ListenAndServe(listen, nil)
+	listener, err := newListener(listenNetwork, listenAddress)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		fatal("ListenAndServe failed", "error", err)
+	}
+	server := &http.Server{}
+	if server.TLSConfig, err = newServerTLSConfig(tlsClientCaFile); err != nil {
+		fatal("Couldn't load TLS client CA", "file", tlsClientCaFile, "error", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(server, listener, tlsCertFile, tlsKeyFile)
+	}()
+
+	select {
+	case err = <-served:
+		fatal("ListenAndServe failed", "error", err)
+	case <-ctx.Done():
+		slog.Info("Shutting down", "reason", "received SIGINT or SIGTERM")
+	}
+	// a second signal kills the process right away
+	stop()
+
+	graceCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(graceCtx); err != nil {
+		slog.Warn("Couldn't finish in-flight scrapes", "error", err)
+	}
+	if err := devices.shutdown(graceCtx); err != nil {
+		slog.Warn("Couldn't stop device pollers", "error", err)
 	}
+	options.Client.CloseIdleConnections()
 }
@@ -0,0 +1,815 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRetryEcoflowApi(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X15", `{"code":"0","message":"Success","data":{"soc":50}}`)
+
+	options := api.options()
+	options.MaxRetries = 2
+	options.RetryBackoff = time.Millisecond
+	device := api.device("X15")
+
+	api.fail("X15", 2, http.StatusBadGateway, nil)
+	res, err := getEcoflowApiData(context.Background(), &device, options)
+	if err != nil || res.Code != "0" {
+		t.Fatalf("got code %s, error %v after two 502 responses, want success", res.Code, err)
+	}
+	if count := api.requestCount("X15"); count != 3 {
+		t.Errorf("got %d requests, want 3", count)
+	}
+
+	// the retries are used up by three failures
+	api.fail("X15", 3, http.StatusServiceUnavailable, nil)
+	res, err = getEcoflowApiData(context.Background(), &device, options)
+	if err == nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, error %v, want the 503", res.StatusCode, err)
+	}
+	if count := api.requestCount("X15"); count != 6 {
+		t.Errorf("got %d requests, want 6", count)
+	}
+
+	// 4xx responses come back the same on a retry
+	api.fail("X15", 1, http.StatusNotFound, nil)
+	if _, err := getEcoflowApiData(context.Background(), &device, options); err == nil {
+		t.Error("got no error for a 404")
+	}
+	if count := api.requestCount("X15"); count != 7 {
+		t.Errorf("got %d requests, want 7, 4xx is not retried", count)
+	}
+}
+
+func TestApiClientCertificate(t *testing.T) {
+	client := newTestCert(t, "client")
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"code":"0","message":"Success","data":{"soc":50}}`))
+	}))
+	server.TLS = &tls.Config{ClientCAs: client.pool(), ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(server.Certificate())
+
+	apiUrl, _ := url.Parse(server.URL)
+	device := Ecoflow{SerialNumber: "X19", AppKey: "key", SecretKey: "secret"}
+	for _, test := range []struct {
+		certFile, keyFile string
+		ok                bool
+	}{
+		{client.certFile, client.keyFile, true},
+		{"", "", false},
+	} {
+		transport, err := newApiTransport("", test.certFile, test.keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = serverCAs
+		options := ExporterOptions{ApiUrl: apiUrl, CheckTimeout: 5 * time.Second, Client: &http.Client{Transport: transport}}
+
+		res, err := getEcoflowApiData(context.Background(), &device, options)
+		if test.ok && (err != nil || res.Code != "0") {
+			t.Errorf("got code %s, error %v with the client certificate, want success", res.Code, err)
+		}
+		if !test.ok && err == nil {
+			t.Error("got no error without a client certificate")
+		}
+	}
+
+	if _, err := newApiTransport("", client.certFile, "/nonexistent"); err == nil {
+		t.Error("got no error for a missing key file")
+	}
+}
+
+func TestClientReusesConnections(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X20", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.setQuota("X21", `{"code":"0","message":"Success","data":{"soc":60}}`)
+
+	transport, err := newApiTransport("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := api.options()
+	options.Client = &http.Client{Transport: transport}
+	defer options.Client.CloseIdleConnections()
+
+	// the devices share the client
+	for i := 0; i < 3; i++ {
+		for _, sn := range []string{"X20", "X21"} {
+			device := api.device(sn)
+			if _, err := getEcoflowApiData(context.Background(), &device, options); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if conns := api.connections(); conns != 1 {
+		t.Errorf("got %d connections for 6 sequential requests, want 1", conns)
+	}
+}
+
+func TestNewEcoflowRequestMalformedUrl(t *testing.T) {
+	device := Ecoflow{SerialNumber: "X22", AppKey: "key", SecretKey: "secret"}
+	options := ExporterOptions{UserAgent: "test", Client: http.DefaultClient, CheckTimeout: time.Second}
+
+	for _, apiUrl := range []string{"http://[::1", "http://host/%zz", "://missing-scheme"} {
+		if req, err := newEcoflowRequest(context.Background(), apiUrl, nil, &device, options); err == nil {
+			t.Errorf("newEcoflowRequest(%q) = %v, want an error", apiUrl, req.URL)
+		}
+		if _, err := getEcoflowBody(apiUrl, false, &device, options); err == nil {
+			t.Errorf("getEcoflowBody(%q) succeeded, want an error", apiUrl)
+		}
+	}
+}
+
+func TestDecodeDevicePayloads(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		body string
+		keys []string
+		data EcoflowApiData
+	}{
+		{
+			name: "DELTA 2",
+			body: `{"code":"0","message":"Success","data":{"soc":83,"remainTime":5999,"wattsOutSum":122,"wattsInSum":0,` +
+				`"model":"DELTA 2","pd.sysVer":16908335,"pd.soc":83,"pd.carWatts":0,"pd.usb1Watts":5,"pd.dcOutState":1,` +
+				`"inv.inputWatts":0,"inv.outputWatts":117,"inv.acInVol":0,"inv.invOutVol":230120,"inv.cfgAcEnabled":1,` +
+				`"mppt.inVol":0,"mppt.inAmp":0,"bms_bmsStatus.temp":24,"bms_emsStatus.chgState":0}}`,
+			keys: []string{"pd.usb1Watts", "inv.invOutVol", "bms_bmsStatus.temp", "bms_emsStatus.chgState"},
+			data: EcoflowApiData{Soc: 83, RemainTime: 5999, WattsOutSum: 122, Model: "DELTA 2", Firmware: "1.2.0.47"},
+		},
+		{
+			name: "PowerStream",
+			body: `{"code":"0","message":"Success","data":{"20_1.pv1InputWatts":1543,"20_1.pv2InputWatts":1210,` +
+				`"20_1.pv1InputVolt":345,"20_1.pv1InputCur":44,"20_1.invOutputWatts":2400,"20_1.batSoc":64,` +
+				`"20_1.permanentWatts":2000,"20_1.invOnOff":1,"20_1.wifiRssi":-52}}`,
+			keys: []string{"20_1.pv1InputWatts", "20_1.pv2InputWatts", "20_1.batSoc", "20_1.wifiRssi"},
+		},
+	} {
+		res, err := decodeEcoflowApi(&Ecoflow{SerialNumber: "X26"}, []byte(test.body))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if res.Code != "0" {
+			t.Errorf("%s: got code %s, want 0", test.name, res.Code)
+		}
+		for _, key := range test.keys {
+			if _, ok := res.Data.number(key); !ok {
+				t.Errorf("%s: key %s was dropped", test.name, key)
+			}
+		}
+		if data := res.Data.apiData(); data != test.data {
+			t.Errorf("%s: got %+v, want %+v", test.name, data, test.data)
+		}
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	serverCert := newTestCert(t, "server")
+	clientCert := newTestCert(t, "client")
+
+	// start serves /metrics and returns its address
+	start := func(clientCaFile string) string {
+		tlsConfig, err := newServerTLSConfig(clientCaFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {})
+		server := &http.Server{Handler: mux, TLSConfig: tlsConfig}
+		go serve(server, listener, serverCert.certFile, serverCert.keyFile)
+		t.Cleanup(func() { server.Close() })
+		return listener.Addr().String()
+	}
+	get := func(client *http.Client, url string) (int, error) {
+		res, err := client.Get(url)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+	tlsClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: serverCert.pool(), Certificates: certs}}}
+	}
+
+	addr := start("")
+	if status, err := get(tlsClient(), "https://"+addr+"/metrics"); err != nil || status != http.StatusOK {
+		t.Errorf("HTTPS: got status %d, error %v, want 200", status, err)
+	}
+	if status, err := get(http.DefaultClient, "http://"+addr+"/metrics"); err == nil && status == http.StatusOK {
+		t.Error("plain HTTP was served by the TLS listener")
+	}
+
+	// with a client CA only clients with a certificate are served
+	addr = start(clientCert.certFile)
+	if _, err := get(tlsClient(), "https://"+addr+"/metrics"); err == nil {
+		t.Error("client without certificate was served")
+	}
+	cert, err := tls.LoadX509KeyPair(clientCert.certFile, clientCert.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := get(tlsClient(cert), "https://"+addr+"/metrics"); err != nil || status != http.StatusOK {
+		t.Errorf("client certificate: got status %d, error %v, want 200", status, err)
+	}
+
+	if _, err := newServerTLSConfig(clientCert.keyFile); err == nil {
+		t.Error("client CA without certificates loaded")
+	}
+}
+
+// histogramOf returns the current state of a histogram
+func histogramOf(t *testing.T, observer prometheus.Observer) *dto.Histogram {
+	var metric dto.Metric
+	if err := observer.(prometheus.Histogram).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram()
+}
+
+func TestApiRequestDuration(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X31", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	options := api.options()
+
+	for i := 0; i < 3; i++ {
+		device := api.device("X31")
+		getEcoflowApiData(context.Background(), &device, options)
+	}
+	// the API doesn't know X32
+	device := api.device("X32")
+	getEcoflowApiData(context.Background(), &device, options)
+
+	for _, test := range []struct {
+		sn, outcome string
+		count       uint64
+	}{
+		{"X31", "success", 3},
+		{"X31", "api_error", 0},
+		{"X32", "api_error", 1},
+	} {
+		if count := histogramOf(t, apiRequestDuration.WithLabelValues(test.sn, test.outcome)).GetSampleCount(); count != test.count {
+			t.Errorf("%s %s: got %d observations, want %d", test.sn, test.outcome, count, test.count)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X36", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	device := "- serialNumber: %s\n  appKey: key\n  secretKey: secret\n"
+
+	var out strings.Builder
+	if code := checkConfig(writeConfig(t, fmt.Sprintf(device, "X36")), api.options(), &out); code != 0 {
+		t.Errorf("got exit code %d for a passing device, want 0:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "PASS    X36") {
+		t.Errorf("no PASS line for X36:\n%s", out.String())
+	}
+
+	// the API doesn't know X37
+	out.Reset()
+	if code := checkConfig(writeConfig(t, fmt.Sprintf(device, "X36")+fmt.Sprintf(device, "X37")), api.options(), &out); code != 1 {
+		t.Errorf("got exit code %d for a failing device, want 1:\n%s", code, out.String())
+	}
+	for _, line := range []string{"PASS    X36", "FAIL    X37  X37          6042  device not found", "1 of 2 devices failed"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("missing %q:\n%s", line, out.String())
+		}
+	}
+
+	out.Reset()
+	if code := checkConfig(writeConfig(t, "- serialNumber: X36\n"), api.options(), &out); code != 1 || !strings.HasPrefix(out.String(), "FAIL invalid config") {
+		t.Errorf("got exit code %d and output %q for an invalid config, want 1 and FAIL invalid config", code, out.String())
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X38", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.fail("X40", 1, http.StatusBadGateway, nil)
+
+	devices := []Ecoflow{api.device("X38"), api.device("X39"), api.device("X40")}
+	if healthy := preflight(devices, api.options()); healthy != 1 {
+		t.Errorf("got %d healthy devices, want 1", healthy)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X44", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	device := api.device("X44")
+
+	options := api.options()
+	if _, err := getEcoflowApiData(context.Background(), &device, options); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := api.lastUserAgent(), "prometheus-ecoflow-exporter/"+version; got != want {
+		t.Errorf("got User-Agent %q, want %q", got, want)
+	}
+
+	options.UserAgent = "custom/1.0"
+	if _, err := getEcoflowApiData(context.Background(), &device, options); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.lastUserAgent(); got != "custom/1.0" {
+		t.Errorf("got User-Agent %q with --user-agent, want custom/1.0", got)
+	}
+}
+
+func TestNewEcoflowRequestShape(t *testing.T) {
+	device := Ecoflow{SerialNumber: "X45", AppKey: "key", SecretKey: "secret"}
+	options := ExporterOptions{UserAgent: "test"}
+
+	req, err := newEcoflowRequest(context.Background(), "https://api.example.com/quota?sn=X45", nil, &device, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != http.MethodGet || req.Body != nil {
+		t.Errorf("without body: got %s with body %v, want GET without body", req.Method, req.Body)
+	}
+
+	device.Quotas = []string{"pd.soc", "inv.inputWatts"}
+	body, err := device.quotaRequestBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = newEcoflowRequest(context.Background(), "https://api.example.com/quota?sn=X45", body, &device, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"sn":"X45","params":{"quotas":["pd.soc","inv.inputWatts"]}}`; req.Method != http.MethodPost || string(sent) != want {
+		t.Errorf("with body: got %s %s, want POST %s", req.Method, sent, want)
+	}
+
+	for name, want := range map[string]string{"Content-Type": "application/json", "User-Agent": "test", "appKey": "key", "secretKey": "secret"} {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestApiRequestBytes(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X46", `{"code":"0","message":"Success","data":{"soc":50}}`)
+
+	for _, quotas := range [][]string{nil, {"soc"}} {
+		device := api.device("X46")
+		device.Quotas = quotas
+		body, _ := device.quotaRequestBody()
+		exporter, err := CreateExporters(device, api.options())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.CollectAndCount(exporter)
+		if size := testutil.ToFloat64(exporter.requestsize); size != float64(len(body)) {
+			t.Errorf("quotas %v: got request size %v, want %d", quotas, size, len(body))
+		}
+		if size := testutil.ToFloat64(exporter.responsesize); size == 0 {
+			t.Errorf("quotas %v: got no response size", quotas)
+		}
+	}
+}
+
+func TestResponseCode(t *testing.T) {
+	for _, test := range []struct {
+		body string
+		code responseCode
+		err  bool
+	}{
+		{`{"code":"0","message":"Success"}`, "0", false},
+		{`{"code":0,"message":"Success"}`, "0", false},
+		{`{"code":"8521","message":"signature is wrong"}`, "8521", false},
+		{`{"code":8521,"message":"signature is wrong"}`, "8521", false},
+		{`{"code":null}`, "", false},
+		{`{"message":"no code"}`, "", false},
+		{`{"code":true}`, "", true},
+		{`{"code":["0"]}`, "", true},
+	} {
+		res, err := decodeEcoflowApi(&Ecoflow{SerialNumber: "X51"}, []byte(test.body))
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v, want error %v", test.body, err, test.err)
+			continue
+		}
+		if res.Code != test.code {
+			t.Errorf("%s: got code %q, want %q", test.body, res.Code, test.code)
+		}
+	}
+}
+
+func TestProxyUrl(t *testing.T) {
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("NO_PROXY", "internal.example.com")
+
+	transport, err := newApiTransport("http://proxy.example.com:3128", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		url, proxy string
+	}{
+		{"https://api.ecoflow.com/iot-service/open/api/device/queryDeviceQuota", "http://proxy.example.com:3128"},
+		{"http://api.ecoflow.com/", "http://proxy.example.com:3128"},
+		// NO_PROXY is still respected
+		{"https://internal.example.com/quota", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		proxy, err := transport.Proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != test.proxy {
+			t.Errorf("%s: got proxy %q, want %q", test.url, got, test.proxy)
+		}
+	}
+}
+
+func TestParseListenAddr(t *testing.T) {
+	for _, test := range []struct {
+		listen           string
+		network, address string
+		err              bool
+	}{
+		{listen: "0.0.0.0:9136", network: "tcp", address: "0.0.0.0:9136"},
+		{listen: ":9136", network: "tcp", address: ":9136"},
+		{listen: "9136", network: "tcp", address: ":9136"},
+		{listen: "localhost:9136", network: "tcp", address: "localhost:9136"},
+		{listen: "[::]:9136", network: "tcp", address: "[::]:9136"},
+		{listen: "[::1]:9136", network: "tcp", address: "[::1]:9136"},
+		{listen: "unix:/run/ecoflow.sock", network: "unix", address: "/run/ecoflow.sock"},
+		{listen: "unix:", err: true},
+		{listen: "0.0.0.0", err: true},
+		{listen: ":0", err: true},
+		{listen: ":65536", err: true},
+		{listen: ":http", err: true},
+		{listen: "::1:9136", err: true},
+		{listen: "[::zz]:9136", err: true},
+	} {
+		network, address, err := parseListenAddr(test.listen)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseListenAddr(%q) = %s %s, want an error", test.listen, network, address)
+			}
+			continue
+		}
+		if err != nil || network != test.network || address != test.address {
+			t.Errorf("parseListenAddr(%q) = %s %s %v, want %s %s", test.listen, network, address, err, test.network, test.address)
+		}
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ecoflow.sock")
+	// a socket file left behind by a previous run
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := newListener("unix", path)
+	if err != nil {
+		t.Fatalf("got %v listening on a stale socket file", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	served := make(chan error, 1)
+	go func() { served <- serve(server, listener, "", "") }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	res, err := client.Get("http://unix/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("got body %q over the socket, want ok", body)
+	}
+
+	// shutting down removes the socket file
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("got %v from serve, want %v", err, http.ErrServerClosed)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("got %v for the socket file after shutdown, want it removed", err)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	for _, test := range []struct {
+		size, limit int64
+		err         bool
+	}{
+		{100, 100, false},
+		{101, 100, true},
+		{1 << 20, 0, false},
+	} {
+		_, err := readBody(strings.NewReader(strings.Repeat("x", int(test.size))), test.limit)
+		if (err != nil) != test.err || (err != nil && !errors.Is(err, errResponseTooLarge)) {
+			t.Errorf("%d bytes with limit %d: got error %v, want too large %v", test.size, test.limit, err, test.err)
+		}
+	}
+
+	// an oversized response fails the scrape without being retried
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X63", `{"code":"0","message":"Success","data":{"padding":"`+strings.Repeat("x", 2048)+`"}}`)
+	options := api.options()
+	options.MaxResponseBytes = 1024
+	options.MaxRetries = 2
+	device := api.device("X63")
+	_, err := getEcoflowApiData(context.Background(), &device, options)
+	if err == nil || !strings.Contains(err.Error(), "more than 1024 bytes") {
+		t.Errorf("got error %v, want the response size error", err)
+	}
+	if count := api.requestCount("X63"); count != 1 {
+		t.Errorf("got %d requests, want 1", count)
+	}
+}
+
+func TestAttemptTimeout(t *testing.T) {
+	options := ExporterOptions{AttemptTimeout: 100 * time.Millisecond, AttemptTimeoutMultiplier: 2}
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		if got := attemptTimeout(attempt, options); got != want {
+			t.Errorf("attempt %d: got timeout %s, want %s", attempt, got, want)
+		}
+	}
+	if got := attemptTimeout(2, ExporterOptions{}); got != 0 {
+		t.Errorf("got timeout %s without --attempt-timeout, want 0", got)
+	}
+	// device settings override the flags
+	device := Ecoflow{AttemptTimeout: time.Second, AttemptTimeoutMultiplier: 1.5}
+	if got := attemptTimeout(2, device.exporterOptions(options)); got != 2250*time.Millisecond {
+		t.Errorf("got timeout %s with the device settings, want 2.25s", got)
+	}
+
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X68", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.setDelay(300 * time.Millisecond)
+
+	for _, test := range []struct {
+		name         string
+		checkTimeout time.Duration
+		multiplier   float64
+		ok           bool
+		requests     int
+	}{
+		// 100ms and 200ms time out, the 400ms of the third attempt are enough
+		{"escalating", 2 * time.Second, 2, true, 3},
+		// every attempt times out after 100ms
+		{"constant", 2 * time.Second, 1, false, 4},
+		// the second attempt is cut short by the check timeout
+		{"budget", 250 * time.Millisecond, 2, false, 2},
+	} {
+		options := api.options()
+		options.CheckTimeout = test.checkTimeout
+		options.AttemptTimeout = 100 * time.Millisecond
+		options.AttemptTimeoutMultiplier = test.multiplier
+		options.MaxRetries = 3
+		options.RetryBackoff = time.Millisecond
+		device := api.device("X68")
+		before := api.requestCount("X68")
+
+		start := time.Now()
+		res, err := getEcoflowApiData(context.Background(), &device, options)
+		elapsed := time.Since(start)
+		if ok := err == nil && res.Code == "0"; ok != test.ok {
+			t.Errorf("%s: got error %v, want success %v", test.name, err, test.ok)
+		}
+		if requests := api.requestCount("X68") - before; requests != test.requests {
+			t.Errorf("%s: got %d requests, want %d", test.name, requests, test.requests)
+		}
+		if elapsed > test.checkTimeout+50*time.Millisecond {
+			t.Errorf("%s: took %s, more than the check timeout %s", test.name, elapsed, test.checkTimeout)
+		}
+	}
+}
+
+func TestScrapeSlotWait(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	api.setQuota("X71", `{"code":"0","message":"Success","data":{"soc":50}}`)
+	api.setQuota("X72", `{"code":"0","message":"Success","data":{"soc":60}}`)
+	api.setDelay(200 * time.Millisecond)
+	options := api.options()
+	options.Semaphore = make(chan struct{}, 1)
+
+	// one of the devices waits for the other
+	waits := testutil.ToFloat64(rateLimitWaits.WithLabelValues("slot"))
+	done := make(chan struct{})
+	for _, sn := range []string{"X71", "X72"} {
+		go func(device Ecoflow) {
+			getEcoflowApiData(context.Background(), &device, options)
+			done <- struct{}{}
+		}(api.device(sn))
+	}
+	<-done
+	<-done
+
+	var waited, requested float64
+	for _, sn := range []string{"X71", "X72"} {
+		wait := histogramOf(t, scrapeSlotWait.WithLabelValues(sn))
+		request := histogramOf(t, apiRequestDuration.WithLabelValues(sn, "success"))
+		if wait.GetSampleCount() != 1 || request.GetSampleCount() != 1 {
+			t.Fatalf("%s: got %d waits and %d requests, want 1 each", sn, wait.GetSampleCount(), request.GetSampleCount())
+		}
+		waited += wait.GetSampleSum()
+		requested = math.Max(requested, request.GetSampleSum())
+	}
+	if waited < 0.2 || waited > 0.35 {
+		t.Errorf("got %vs waited, want about one request", waited)
+	}
+	if got := testutil.ToFloat64(rateLimitWaits.WithLabelValues("slot")) - waits; got != 1 {
+		t.Errorf("got %v slot waits, want 1", got)
+	}
+	// the requests themselves aren't slowed down by the wait
+	if requested < 0.2 || requested > 0.35 {
+		t.Errorf("got requests of up to %vs, want about 0.2", requested)
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	options := api.options()
+	options.AvailabilityDecay = 0.5
+	exporter, err := CreateExporters(api.device("A1"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, step := range []struct {
+		ok   bool
+		want float64
+	}{
+		// the first scrape seeds the average
+		{true, 1},
+		{false, 0.5},
+		{false, 0.25},
+		{true, 0.625},
+		{true, 0.8125},
+	} {
+		exporter.setCheckResult(step.ok)
+		if got := testutil.ToFloat64(exporter.availability); got != step.want {
+			t.Errorf("step %d (ok %v): got availability %v, want %v", i, step.ok, got, step.want)
+		}
+	}
+}
+
+func TestAcceptableStatus(t *testing.T) {
+	var status atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(int(status.Load()))
+		w.Write([]byte(`{"code":"0","message":"Success","data":{"soc":50}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	api := newMockApi(t, "key", "secret")
+	options := api.options()
+	options.ApiUrl, _ = url.Parse(server.URL)
+	options.AcceptableStatus = []int{200, 203}
+	exporter, err := CreateExporters(api.device("C1"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		status int
+		up     float64
+	}{
+		{http.StatusOK, 1},
+		{http.StatusNonAuthoritativeInfo, 1},
+		// other statuses fail, 2xx ones included
+		{http.StatusAccepted, 0},
+		{http.StatusNotFound, 0},
+	} {
+		status.Store(int32(test.status))
+		testutil.CollectAndCount(exporter)
+		exporter.mutex.RLock()
+		up := testutil.ToFloat64(exporter.up)
+		exporter.mutex.RUnlock()
+		if up != test.up {
+			t.Errorf("status %d: got up %v, want %v", test.status, up, test.up)
+		}
+	}
+
+	if !statusAcceptable(http.StatusNoContent, nil) || statusAcceptable(http.StatusFound, nil) {
+		t.Error("without configured statuses any 2xx should be acceptable and nothing else")
+	}
+}
+
+func TestAwaitStartup(t *testing.T) {
+	started, err := awaitStartup(0, false, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	default:
+		t.Error("not started after a successful startup")
+	}
+
+	failure := errors.New("broken config")
+	if _, err := awaitStartup(time.Minute, false, func() error { return failure }); !errors.Is(err, failure) {
+		t.Errorf("got %v, want the startup failure", err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	if _, err := awaitStartup(10*time.Millisecond, false, func() error {
+		<-release
+		return nil
+	}); err == nil {
+		t.Error("got no error for a startup past the timeout")
+	}
+}
+
+func TestAwaitStartupDegraded(t *testing.T) {
+	captureLogs(t, slog.LevelError)
+
+	for _, test := range []struct {
+		err     error
+		started bool
+	}{
+		{nil, true},
+		// a failure past the timeout is logged instead of exiting, the test
+		// process wouldn't survive a fatal
+		{errors.New("no healthy devices"), false},
+	} {
+		release := make(chan struct{})
+		finished := make(chan struct{})
+		started, err := awaitStartup(10*time.Millisecond, true, func() error {
+			defer close(finished)
+			<-release
+			return test.err
+		})
+		if err != nil {
+			t.Fatalf("got %v in degraded mode, want serving", err)
+		}
+		select {
+		case <-started:
+			t.Fatal("started before startup finished")
+		default:
+		}
+
+		close(release)
+		<-finished
+		select {
+		case <-started:
+			if !test.started {
+				t.Errorf("started after startup failed with %v", test.err)
+			}
+		case <-time.After(time.Second):
+			if test.started {
+				t.Error("not started after startup finished")
+			}
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMain(m *testing.M) {
+	initMetrics(prometheus.DefBuckets)
+	os.Exit(m.Run())
+}
+
+// mockApi is a fake EcoFlow API serving the quota, device list and MQTT
+// certification endpoints for one pair of keys and the accounts added with addAccount. Requests with
+// other keys get the API's auth error.
+type mockApi struct {
+	t         *testing.T
+	server    *httptest.Server
+	appKey    string
+	secretKey string
+
+	mutex    sync.Mutex
+	quotas   map[string]string
+	devices  []EcoflowListedDevice
+	accounts map[string]mockAccount
+	requests map[string]int
+	// first is the time of the first quota request of every device
+	first    map[string]time.Time
+	failures map[string]mockFailure
+	// delay is slept before answering a quota request
+	delay time.Duration
+	// aborted counts the quota requests canceled by the client during delay
+	aborted int
+	// userAgent is the User-Agent of the last request
+	userAgent string
+	// conns is the number of connections accepted
+	conns int
+}
+
+// mockAccount is another pair of keys with its device list
+type mockAccount struct {
+	secretKey string
+	devices   []EcoflowListedDevice
+}
+
+// mockFailure is an HTTP error answered to the next count quota requests of a
+// device
+type mockFailure struct {
+	count  int
+	status int
+	header http.Header
+}
+
+const (
+	mockQuotaPath = "/iot-service/open/api/device/queryDeviceQuota"
+	mockListPath  = "/iot-service/open/api/device/list"
+	mockCertPath  = "/iot-open/sign/certification"
+)
+
+// newMockApi starts the fake API, it is closed with the test
+func newMockApi(t *testing.T, appKey, secretKey string) *mockApi {
+	api := &mockApi{
+		t:         t,
+		appKey:    appKey,
+		secretKey: secretKey,
+		quotas:    make(map[string]string),
+		accounts:  make(map[string]mockAccount),
+		requests:  make(map[string]int),
+		first:     make(map[string]time.Time),
+		failures:  make(map[string]mockFailure),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(mockQuotaPath, api.serveQuota)
+	mux.HandleFunc(mockListPath, api.serveList)
+	mux.HandleFunc(mockCertPath, api.serveCertification)
+	api.server = httptest.NewUnstartedServer(mux)
+	api.server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			api.mutex.Lock()
+			api.conns++
+			api.mutex.Unlock()
+		}
+	}
+	api.server.Start()
+	t.Cleanup(api.server.Close)
+	return api
+}
+
+// setQuota sets the raw response body for the device
+func (api *mockApi) setQuota(sn, body string) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	api.quotas[sn] = body
+}
+
+// setDevices sets the devices of the device list
+func (api *mockApi) setDevices(devices ...EcoflowListedDevice) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	api.devices = devices
+}
+
+// addAccount adds another pair of keys listing the devices
+func (api *mockApi) addAccount(appKey, secretKey string, devices ...EcoflowListedDevice) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	api.accounts[appKey] = mockAccount{secretKey: secretKey, devices: devices}
+}
+
+// fail answers the next count quota requests of the device with the status
+// and header
+func (api *mockApi) fail(sn string, count, status int, header http.Header) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	api.failures[sn] = mockFailure{count: count, status: status, header: header}
+}
+
+// setDelay makes the quota requests take at least d
+func (api *mockApi) setDelay(d time.Duration) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	api.delay = d
+}
+
+// requestCount returns the number of quota requests for the device
+func (api *mockApi) requestCount(sn string) int {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	return api.requests[sn]
+}
+
+// firstRequest returns the time of the first quota request of the device, zero
+// if there was none
+func (api *mockApi) firstRequest(sn string) time.Time {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	return api.first[sn]
+}
+
+// abortedCount returns the number of quota requests canceled by the client
+func (api *mockApi) abortedCount() int {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	return api.aborted
+}
+
+// lastUserAgent returns the User-Agent of the last request
+func (api *mockApi) lastUserAgent() string {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	return api.userAgent
+}
+
+// connections returns the number of connections accepted so far
+func (api *mockApi) connections() int {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	return api.conns
+}
+
+// options returns the exporter defaults of main pointed at the fake API
+func (api *mockApi) options() ExporterOptions {
+	apiUrl, _ := url.Parse(api.server.URL + mockQuotaPath)
+	deviceListUrl, _ := url.Parse(api.server.URL + mockListPath)
+	certificationUrl, _ := url.Parse(api.server.URL + mockCertPath)
+	return ExporterOptions{
+		ApiUrl:               apiUrl,
+		DeviceListUrl:        deviceListUrl,
+		MqttCertificationUrl: certificationUrl,
+		CheckTimeout:         5 * time.Second,
+		Client:               api.server.Client(),
+		UserAgent:            defaultUserAgent(),
+		MaxResponseBytes:     1 << 20,
+		ErrorThreshold:       1,
+		RecoverThreshold:     1,
+		SuccessWindow:        10,
+		AvailabilityDecay:    0.05,
+		StaleOnError:         true,
+	}
+}
+
+// device returns a config entry with the keys of the fake API
+func (api *mockApi) device(sn string) Ecoflow {
+	return Ecoflow{SerialNumber: sn, Description: sn, AppKey: api.appKey, SecretKey: api.secretKey}
+}
+
+// authorized checks the headers every API request must have
+func (api *mockApi) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("User-Agent") == "" {
+		api.t.Errorf("%s request without User-Agent", r.URL.Path)
+	}
+	appKey, secretKey := r.Header.Get("appKey"), r.Header.Get("secretKey")
+	api.mutex.Lock()
+	api.userAgent = r.Header.Get("User-Agent")
+	account, ok := api.accounts[appKey]
+	api.mutex.Unlock()
+	if (appKey != api.appKey || secretKey != api.secretKey) && (!ok || secretKey != account.secretKey) {
+		api.write(w, `{"code":"8521","message":"signature is wrong"}`)
+		return false
+	}
+	return true
+}
+
+func (api *mockApi) serveQuota(w http.ResponseWriter, r *http.Request) {
+	sn := r.URL.Query().Get("sn")
+	api.mutex.Lock()
+	api.requests[sn]++
+	if _, ok := api.first[sn]; !ok {
+		api.first[sn] = time.Now()
+	}
+	body, ok := api.quotas[sn]
+	failure, failing := api.failures[sn]
+	delay := api.delay
+	if failing {
+		failure.count--
+		if failure.count == 0 {
+			delete(api.failures, sn)
+		} else {
+			api.failures[sn] = failure
+		}
+	}
+	api.mutex.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+		api.mutex.Lock()
+		api.aborted++
+		api.mutex.Unlock()
+		return
+	}
+
+	if failing {
+		for name, values := range failure.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(failure.status)
+		return
+	}
+
+	if !api.authorized(w, r) {
+		return
+	}
+	if !ok {
+		api.write(w, `{"code":"6042","message":"device not found"}`)
+		return
+	}
+	api.write(w, body)
+}
+
+func (api *mockApi) serveList(w http.ResponseWriter, r *http.Request) {
+	if !api.authorized(w, r) {
+		return
+	}
+	api.mutex.Lock()
+	devices := api.devices
+	if account, ok := api.accounts[r.Header.Get("appKey")]; ok {
+		devices = account.devices
+	}
+	data, err := json.Marshal(map[string]interface{}{"code": "0", "message": "Success", "data": devices})
+	api.mutex.Unlock()
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	api.write(w, string(data))
+}
+
+// serveCertification checks the signature of the request the way the iot-open
+// endpoints do, computed here independently of signEcoflowRequest
+func (api *mockApi) serveCertification(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("appKey") != "" || r.Header.Get("secretKey") != "" {
+		api.t.Errorf("%s request with the plain keys", r.URL.Path)
+	}
+	accessKey, nonce, timestamp := r.Header.Get("accessKey"), r.Header.Get("nonce"), r.Header.Get("timestamp")
+	api.mutex.Lock()
+	secretKey := api.secretKey
+	if account, ok := api.accounts[accessKey]; ok {
+		secretKey = account.secretKey
+	} else if accessKey != api.appKey {
+		secretKey = ""
+	}
+	api.mutex.Unlock()
+
+	mac := hmac.New(sha256.New, []byte(secretKey))
+	fmt.Fprintf(mac, "accessKey=%s&nonce=%s&timestamp=%s", accessKey, nonce, timestamp)
+	millis, err := strconv.ParseInt(timestamp, 10, 64)
+	if secretKey == "" || nonce == "" || err != nil || time.Since(time.UnixMilli(millis)).Abs() > time.Minute ||
+		!hmac.Equal([]byte(r.Header.Get("sign")), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		api.write(w, `{"code":"8521","message":"signature is wrong"}`)
+		return
+	}
+	api.write(w, `{"code":"0","message":"Success","data":{"certificateAccount":"open-account","certificatePassword":"password","url":"127.0.0.1","port":"8883","protocol":"mqtts"}}`)
+}
+
+func (api *mockApi) write(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(body))
+}
+
+// fakeClock is a clock for ExporterOptions.Now that only moves when advanced
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+// captureLogs sends the default logger to the returned buffer as JSON until the
+// test ends
+func captureLogs(t *testing.T, level slog.Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
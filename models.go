@@ -0,0 +1,223 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+//go:embed models.yaml
+var modelsYaml []byte
+
+// defaultLayout is the layout of models missing in the table
+const defaultLayout = "delta2"
+
+// modelTable maps the models reported by the API to their quota key layouts
+type modelTable struct {
+	Layouts map[string]electricalMeters `yaml:"layouts"`
+	Models  map[string]string           `yaml:"models"`
+}
+
+// defaultModels is the table shipped in models.yaml
+var defaultModels = mustParseModels(modelsYaml)
+
+func mustParseModels(data []byte) modelTable {
+	var table modelTable
+	if err := yaml.UnmarshalStrict(data, &table); err != nil {
+		panic(err)
+	}
+	table, err := modelTable{}.with(table)
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+// with returns the table with the layouts and models of overrides added, model
+// names are stored upper case
+func (table modelTable) with(overrides modelTable) (modelTable, error) {
+	merged := modelTable{
+		Layouts: make(map[string]electricalMeters, len(table.Layouts)+len(overrides.Layouts)),
+		Models:  make(map[string]string, len(table.Models)+len(overrides.Models)),
+	}
+	for _, source := range []modelTable{table, overrides} {
+		for name, layout := range source.Layouts {
+			merged.Layouts[name] = layout
+		}
+		for model, layout := range source.Models {
+			merged.Models[strings.ToUpper(model)] = layout
+		}
+	}
+
+	var problems []string
+	for name, layout := range merged.Layouts {
+		problems = append(problems, layout.duplicateChannels(name)...)
+	}
+	for model, layout := range merged.Models {
+		if _, ok := merged.Layouts[layout]; !ok {
+			problems = append(problems, fmt.Sprintf("model %s has unknown layout %q", model, layout))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return merged, fmt.Errorf("invalid models: %s", strings.Join(problems, "; "))
+	}
+	return merged, nil
+}
+
+// metersOf returns the key layout of the model, nil is the default table
+func (table *modelTable) metersOf(model string) electricalMeters {
+	if table == nil {
+		table = &defaultModels
+	}
+	if layout, ok := table.Models[strings.ToUpper(model)]; ok {
+		return table.Layouts[layout]
+	}
+	return table.Layouts[defaultLayout]
+}
+
+// duplicateChannels describes the channels and ports listed more than once for
+// a metric of the layout, they would be reported as the same series
+func (meters electricalMeters) duplicateChannels(layout string) []string {
+	channels := map[string][]string{
+		"wattsIn":        channelNames(meters.wattsIn),
+		"wattsOut":       channelNames(meters.wattsOut),
+		"inputVolts":     meterChannels(meters.inputVolts),
+		"outputVolts":    meterChannels(meters.outputVolts),
+		"inputAmps":      meterChannels(meters.inputAmps),
+		"outputAmps":     meterChannels(meters.outputAmps),
+		"solarWatts":     meterChannels(meters.solarWatts),
+		"solarVolts":     meterChannels(meters.solarVolts),
+		"solarAmps":      meterChannels(meters.solarAmps),
+		"outputSwitches": switchPorts(meters.outputSwitches),
+	}
+	var problems []string
+	for metric, names := range channels {
+		seen := make(map[string]bool, len(names))
+		for _, name := range names {
+			if seen[name] {
+				problems = append(problems, fmt.Sprintf("layout %s lists channel %q of %s twice", layout, name, metric))
+			}
+			seen[name] = true
+		}
+	}
+	return problems
+}
+
+func channelNames(channels []powerChannel) []string {
+	names := make([]string, len(channels))
+	for i, channel := range channels {
+		names[i] = channel.name
+	}
+	return names
+}
+
+func meterChannels(meters []meter) []string {
+	names := make([]string, len(meters))
+	for i, meter := range meters {
+		names[i] = meter.channel
+	}
+	return names
+}
+
+func switchPorts(switches []outputSwitch) []string {
+	names := make([]string, len(switches))
+	for i, output := range switches {
+		names[i] = output.port
+	}
+	return names
+}
+
+func (channel *powerChannel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value struct {
+		Channel string   `yaml:"channel"`
+		Keys    []string `yaml:"keys"`
+	}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	if len(value.Keys) == 0 {
+		return fmt.Errorf("power channel %q without keys", value.Channel)
+	}
+	*channel = powerChannel{name: value.Channel, keys: value.Keys}
+	return nil
+}
+
+func (output *outputSwitch) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value struct {
+		Port    string   `yaml:"port"`
+		Keys    []string `yaml:"keys"`
+		Present bool     `yaml:"present"`
+	}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	if len(value.Keys) == 0 {
+		return fmt.Errorf("output switch of port %q without keys", value.Port)
+	}
+	*output = outputSwitch{port: value.Port, keys: value.Keys, present: value.Present}
+	return nil
+}
+
+func (m *meter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value struct {
+		Channel string   `yaml:"channel"`
+		Key     string   `yaml:"key"`
+		Scale   *float64 `yaml:"scale"`
+	}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	if value.Key == "" {
+		return fmt.Errorf("meter of channel %q without key", value.Channel)
+	}
+	*m = meter{channel: value.Channel, key: value.Key, scale: 1}
+	if value.Scale != nil {
+		m.scale = *value.Scale
+	}
+	return nil
+}
+
+func (meters *electricalMeters) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value struct {
+		WattsIn     []powerChannel `yaml:"wattsIn"`
+		WattsOut    []powerChannel `yaml:"wattsOut"`
+		InputVolts  []meter        `yaml:"inputVolts"`
+		OutputVolts []meter        `yaml:"outputVolts"`
+		InputAmps   []meter        `yaml:"inputAmps"`
+		OutputAmps  []meter        `yaml:"outputAmps"`
+		SolarWatts  []meter        `yaml:"solarWatts"`
+		SolarVolts  []meter        `yaml:"solarVolts"`
+		SolarAmps   []meter        `yaml:"solarAmps"`
+		Generated   string         `yaml:"generated"`
+
+		AcTargetVolts     *meter `yaml:"acTargetVolts"`
+		AcTargetFrequency *meter `yaml:"acTargetFrequency"`
+
+		OutputSwitches []outputSwitch `yaml:"outputSwitches"`
+	}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*meters = electricalMeters{
+		wattsIn:     value.WattsIn,
+		wattsOut:    value.WattsOut,
+		inputVolts:  value.InputVolts,
+		outputVolts: value.OutputVolts,
+		inputAmps:   value.InputAmps,
+		outputAmps:  value.OutputAmps,
+		solarWatts:  value.SolarWatts,
+		solarVolts:  value.SolarVolts,
+		solarAmps:   value.SolarAmps,
+		generated:   value.Generated,
+
+		acTargetVolts:     value.AcTargetVolts,
+		acTargetFrequency: value.AcTargetFrequency,
+
+		outputSwitches: value.OutputSwitches,
+	}
+	return nil
+}
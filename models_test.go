@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefaultModels(t *testing.T) {
+	for model, layout := range defaultModels.Models {
+		if _, ok := defaultModels.Layouts[layout]; !ok {
+			t.Errorf("model %s has unknown layout %q", model, layout)
+		}
+	}
+	if meters := defaultModels.metersOf("River 2"); meters.generated != "pd.chgSunPower" {
+		t.Errorf("got generated %q for River 2, want pd.chgSunPower", meters.generated)
+	}
+	if meters := defaultModels.metersOf("SMART GENERATOR"); meters.solarWatts[0].key != "mppt.inWatts" {
+		t.Errorf("unknown model got solar watts %q, want the default layout", meters.solarWatts[0].key)
+	}
+	// a missing scale is 1
+	if scale := defaultModels.metersOf("DELTA 2").solarWatts[0].scale; scale != 1 {
+		t.Errorf("got solar watts scale %v, want 1", scale)
+	}
+}
+
+func TestConfigModels(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, `
+layouts:
+  delta3:
+    solarWatts: [{channel: "1", key: mppt.pv1Watts}, {channel: "2", key: mppt.pv2Watts}]
+models:
+  Delta 3: delta3
+  Delta Max: delta2
+devices:
+  - serialNumber: A1
+    appKey: k
+    secretKey: s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meters := config.models.metersOf("DELTA 3"); len(meters.solarWatts) != 2 || meters.solarWatts[1].key != "mppt.pv2Watts" {
+		t.Errorf("got solar watts %v for DELTA 3, want the config layout", meters.solarWatts)
+	}
+	if scale := config.models.metersOf("DELTA MAX").solarVolts[0].scale; scale != 0.1 {
+		t.Errorf("got solar volts scale %v for DELTA MAX, want 0.1 of the overriding delta2 layout", scale)
+	}
+	if meters := config.models.metersOf("DELTA PRO"); meters.solarVolts[0].scale != 0.001 {
+		t.Errorf("DELTA PRO lost its layout: %v", meters.solarVolts)
+	}
+
+	_, err = loadConfig(writeConfig(t, "models:\n  DELTA 3: delta4\ndevices:\n  - serialNumber: A1\n    appKey: k\n    secretKey: s\n"))
+	if err == nil || !strings.Contains(err.Error(), `model DELTA 3 has unknown layout "delta4"`) {
+		t.Errorf("got error %v, want the unknown layout", err)
+	}
+}
+
+func TestModelsDuplicateChannel(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, `
+layouts:
+  delta3:
+    solarWatts: [{channel: "1", key: mppt.pv1Watts}, {channel: "1", key: mppt.pv2Watts}]
+devices:
+  - serialNumber: A1
+    appKey: k
+    secretKey: s
+`))
+	if err == nil || !strings.Contains(err.Error(), `layout delta3 lists channel "1" of solarWatts twice`) {
+		t.Errorf("got error %v, want the duplicate channel", err)
+	}
+
+	_, err = loadConfig(writeConfig(t, `
+layouts:
+  delta3:
+    wattsOut: [{channel: ac, keys: [inv.outputWatts]}, {channel: ac, keys: [inv.acOutWatts]}]
+    outputSwitches: [{port: dc, keys: [pd.dcOutState]}, {port: dc, keys: [mppt.carState]}]
+devices:
+  - serialNumber: A1
+    appKey: k
+    secretKey: s
+`))
+	for _, want := range []string{`layout delta3 lists channel "ac" of wattsOut twice`, `layout delta3 lists channel "dc" of outputSwitches twice`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want %s", err, want)
+		}
+	}
+}
+
+func TestConfigModelsPowerAndSwitches(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, `
+layouts:
+  delta3:
+    wattsIn: [{channel: ac, keys: [inv.acInWatts]}]
+    outputSwitches: [{port: ac, keys: [inv.acOutState]}]
+models:
+  Delta 3: delta3
+devices:
+  - serialNumber: A1
+    appKey: k
+    secretKey: s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meters := config.models.metersOf("DELTA 3")
+	if len(meters.wattsIn) != 1 || meters.wattsIn[0].keys[0] != "inv.acInWatts" {
+		t.Errorf("got watts in %v for DELTA 3, want the config layout", meters.wattsIn)
+	}
+	if len(meters.outputSwitches) != 1 || meters.outputSwitches[0].keys[0] != "inv.acOutState" {
+		t.Errorf("got switches %v for DELTA 3, want the config layout", meters.outputSwitches)
+	}
+
+	_, err = loadConfig(writeConfig(t, "layouts:\n  delta3:\n    wattsIn: [{channel: ac}]\ndevices:\n  - serialNumber: A1\n    appKey: k\n    secretKey: s\n"))
+	if err == nil || !strings.Contains(err.Error(), `power channel "ac" without keys`) {
+		t.Errorf("got error %v, want the channel without keys", err)
+	}
+}
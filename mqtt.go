@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	transportHttp = "http"
+	transportMqtt = "mqtt"
+
+	// mqttRetryInterval is the wait before the certification is requested again
+	mqttRetryInterval = 30 * time.Second
+)
+
+// EcoflowMqttCertification is the response of the MQTT certification API, the
+// broker and the credentials to subscribe with
+type EcoflowMqttCertification struct {
+	Code    responseCode
+	Message string
+	Data    struct {
+		CertificateAccount  string `json:"certificateAccount"`
+		CertificatePassword string `json:"certificatePassword"`
+		Url                 string `json:"url"`
+		Port                string `json:"port"`
+		Protocol            string `json:"protocol"`
+	}
+}
+
+// getEcoflowMqttCertification requests the MQTT credentials of the account the
+// keys belong to
+func getEcoflowMqttCertification(ecoflow *Ecoflow, options ExporterOptions) (EcoflowMqttCertification, error) {
+	var certification EcoflowMqttCertification
+	body, err := getEcoflowBody(options.MqttCertificationUrl.String(), true, ecoflow, options)
+	if err != nil {
+		return certification, err
+	}
+	if err := json.Unmarshal(body, &certification); err != nil {
+		return certification, err
+	}
+	if "0" != certification.Code {
+		return certification, fmt.Errorf("code %s, %s", certification.Code, certification.Message)
+	}
+	return certification, nil
+}
+
+// subscribe keeps an MQTT subscription to the quota topic of the device until
+// ctx is done. Reconnects are handled by the client, a failed certification is
+// retried every mqttRetryInterval.
+func (ecoflow *EcoflowExporter) subscribe(ctx context.Context) {
+	for {
+		certification, err := getEcoflowMqttCertification(ecoflow.ecoflow, ecoflow.options)
+		if err == nil {
+			ecoflow.runMqtt(ctx, certification)
+			return
+		}
+
+		ecoflow.mqttFailed("Couldn't get MQTT certification", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(mqttRetryInterval):
+		}
+	}
+}
+
+// runMqtt connects to the broker and subscribes to the quota topic until ctx is
+// done
+func (ecoflow *EcoflowExporter) runMqtt(ctx context.Context, certification EcoflowMqttCertification) {
+	sn := ecoflow.ecoflow.SerialNumber
+	scheme := "tcp"
+	if certification.Data.Protocol == "mqtts" {
+		scheme = "ssl"
+	}
+	topic := fmt.Sprintf("/open/%s/%s/quota", certification.Data.CertificateAccount, sn)
+
+	clientOptions := mqtt.NewClientOptions().
+		AddBroker(fmt.Sprintf("%s://%s:%s", scheme, certification.Data.Url, certification.Data.Port)).
+		SetClientID(fmt.Sprintf("prometheus-ecoflow-exporter-%s-%d", sn, time.Now().UnixNano())).
+		SetUsername(certification.Data.CertificateAccount).
+		SetPassword(certification.Data.CertificatePassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectTimeout(ecoflow.options.CheckTimeout).
+		// a reconnect starts a new session, so the topic is subscribed on every connect
+		SetOnConnectHandler(func(client mqtt.Client) {
+			token := client.Subscribe(topic, 1, ecoflow.handleMqttMessage)
+			if err := waitToken(token, ecoflow.options.CheckTimeout); err != nil {
+				ecoflow.mqttFailed("Couldn't subscribe to MQTT quota topic", err)
+			}
+		}).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			ecoflow.mqttFailed("MQTT connection lost", err)
+		})
+
+	client := mqtt.NewClient(clientOptions)
+	// with connect retry the token only completes once connected, the device
+	// fails until then
+	if err := waitToken(client.Connect(), ecoflow.options.CheckTimeout); err != nil {
+		ecoflow.mqttFailed("Couldn't connect to MQTT broker, retrying", err)
+	}
+	<-ctx.Done()
+	client.Disconnect(250)
+}
+
+// waitToken waits for an MQTT operation, not completing within timeout is an
+// error
+func waitToken(token mqtt.Token, timeout time.Duration) error {
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("no answer of the MQTT broker within %s", timeout)
+	}
+	return token.Error()
+}
+
+// mqttFailed logs an MQTT failure and reports it as a failed scrape
+func (ecoflow *EcoflowExporter) mqttFailed(msg string, err error) {
+	slog.Warn(msg, "sn", ecoflow.ecoflow.SerialNumber, "error", err)
+	ecoflow.mutex.Lock()
+	ecoflow.update(EcoflowApi{}, err, 0)
+	ecoflow.mutex.Unlock()
+}
+
+// handleMqttMessage merges a quota message into the last values. Messages only
+// carry the changed keys, usually under "params".
+func (ecoflow *EcoflowExporter) handleMqttMessage(client mqtt.Client, message mqtt.Message) {
+	var payload struct {
+		Params quota `json:"params"`
+	}
+	if err := json.Unmarshal(message.Payload(), &payload); err != nil {
+		slog.Warn("Ignoring undecodable MQTT message", "sn", ecoflow.ecoflow.SerialNumber, "error", err)
+		return
+	}
+	changed := payload.Params
+	if changed == nil {
+		if err := json.Unmarshal(message.Payload(), &changed); err != nil {
+			return
+		}
+	}
+
+	ecoflow.mutex.Lock()
+	defer ecoflow.mutex.Unlock()
+
+	merged := make(quota, len(ecoflow.quotaData)+len(changed))
+	for key, value := range ecoflow.quotaData {
+		merged[key] = value
+	}
+	for key, value := range changed {
+		merged[key] = value
+	}
+	ecoflow.update(EcoflowApi{Code: "0", Data: merged, ResponseBytes: len(message.Payload()), Body: message.Payload()}, nil, 0)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeMessage is an MQTT message with just a payload
+type fakeMessage struct {
+	payload string
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 1 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return "/open/account/X17/quota" }
+func (m fakeMessage) MessageID() uint16 { return 1 }
+func (m fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m fakeMessage) Ack()              {}
+
+func TestHandleMqttMessage(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	device := api.device("X17")
+	device.Transport = transportMqtt
+	exporter, err := CreateExporters(device, api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// messages only carry the changed keys
+	exporter.handleMqttMessage(nil, fakeMessage{`{"params":{"soc":40,"wattsInSum":100}}`})
+	exporter.handleMqttMessage(nil, fakeMessage{`{"params":{"wattsInSum":120}}`})
+	exporter.handleMqttMessage(nil, fakeMessage{`{"wattsOutSum":30}`})
+	exporter.handleMqttMessage(nil, fakeMessage{`not json`})
+
+	expected := `
+# HELP ecoflow_soc State of charge
+# TYPE ecoflow_soc gauge
+ecoflow_soc{description="X17",sn="X17"} 40
+# HELP ecoflow_watts_in_sum Current wats input
+# TYPE ecoflow_watts_in_sum gauge
+ecoflow_watts_in_sum{description="X17",sn="X17"} 120
+# HELP ecoflow_watts_out_sum Current wats output
+# TYPE ecoflow_watts_out_sum gauge
+ecoflow_watts_out_sum{description="X17",sn="X17"} 30
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_soc", "ecoflow_watts_in_sum", "ecoflow_watts_out_sum"); err != nil {
+		t.Error(err)
+	}
+	// collecting an mqtt device never polls
+	if count := api.requestCount("X17"); count != 0 {
+		t.Errorf("got %d quota requests, want 0", count)
+	}
+}
+
+func TestRunMqttConnectFailure(t *testing.T) {
+	// a closed port, the client keeps retrying
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	api := newMockApi(t, "key", "secret")
+	device := api.device("X18")
+	device.Transport = transportMqtt
+	options := api.options()
+	options.CheckTimeout = 100 * time.Millisecond
+	exporter, err := CreateExporters(device, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var certification EcoflowMqttCertification
+	certification.Data.Url = "127.0.0.1"
+	certification.Data.Port = port
+	certification.Data.CertificateAccount = "account"
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		exporter.runMqtt(ctx, certification)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		exporter.mutex.RLock()
+		scraped, ok := exporter.scraped, exporter.ok
+		exporter.mutex.RUnlock()
+		if scraped {
+			if ok {
+				t.Fatal("device is up without a broker")
+			}
+			return
+		}
+	}
+	t.Fatal("the failing connect was never reported")
+}
+
+func TestGetEcoflowMqttCertificationSigned(t *testing.T) {
+	api := newMockApi(t, "key", "secret")
+	device := api.device("X47")
+	certification, err := getEcoflowMqttCertification(&device, api.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certification.Data.CertificateAccount != "open-account" || certification.Data.Port != "8883" {
+		t.Errorf("got certification %+v", certification.Data)
+	}
+
+	// the signature keyed by a wrong secret is rejected
+	device.SecretKey = "wrong"
+	if _, err := getEcoflowMqttCertification(&device, api.options()); err == nil || !strings.Contains(err.Error(), "8521") {
+		t.Errorf("got %v with a wrong secretKey, want code 8521", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// scrapeOrder hands out the --max-concurrent-scrapes slots of a scrape in a
+// fixed order. The registry collects the devices in parallel, so without it
+// the device winning a slot is random. Link group members take their turns
+// like the other devices.
+type scrapeOrder struct {
+	mutex  sync.Mutex
+	turns  []chan struct{}
+	passed []bool
+	index  map[string]int
+}
+
+// newScrapeOrder returns the order of the exporters, sorted by sortByPriority
+func newScrapeOrder(exporters []*EcoflowExporter) *scrapeOrder {
+	order := &scrapeOrder{
+		turns:  make([]chan struct{}, len(exporters)),
+		passed: make([]bool, len(exporters)),
+		index:  make(map[string]int, len(exporters)),
+	}
+	for i, exporter := range exporters {
+		order.turns[i] = make(chan struct{})
+		order.index[exporter.ecoflow.SerialNumber] = i
+	}
+	return order
+}
+
+// pass marks the turn of the device as taken, once it got a slot or finished
+// its scrape without one
+func (order *scrapeOrder) pass(sn string) {
+	i, ok := order.index[sn]
+	if !ok {
+		return
+	}
+	order.mutex.Lock()
+	defer order.mutex.Unlock()
+	if !order.passed[i] {
+		order.passed[i] = true
+		close(order.turns[i])
+	}
+}
+
+// wait blocks until the devices before sn took their turns, a device outside
+// the order doesn't wait
+func (order *scrapeOrder) wait(ctx context.Context, sn string) error {
+	i, ok := order.index[sn]
+	if !ok {
+		return nil
+	}
+	for _, turn := range order.turns[:i] {
+		select {
+		case <-turn:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+type scrapeOrderKey struct{}
+
+// withScrapeOrder carries the order in the context of a scrape
+func withScrapeOrder(ctx context.Context, order *scrapeOrder) context.Context {
+	return context.WithValue(ctx, scrapeOrderKey{}, order)
+}
+
+// waitScrapeTurn blocks until the devices ordered before sn got a slot,
+// without an order it returns at once
+func waitScrapeTurn(ctx context.Context, sn string) error {
+	if order, ok := ctx.Value(scrapeOrderKey{}).(*scrapeOrder); ok {
+		return order.wait(ctx, sn)
+	}
+	return nil
+}
+
+// passScrapeTurn lets the device after sn go
+func passScrapeTurn(ctx context.Context, sn string) {
+	if order, ok := ctx.Value(scrapeOrderKey{}).(*scrapeOrder); ok {
+		order.pass(sn)
+	}
+}
+
+// sortByPriority orders the exporters by descending priority, then by serial
+// number
+func sortByPriority(exporters []*EcoflowExporter) {
+	sort.Slice(exporters, func(i, j int) bool {
+		a, b := exporters[i].ecoflow, exporters[j].ecoflow
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.SerialNumber < b.SerialNumber
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// postProcessor derives an additional metric from the parsed API data. derive
+// returns false when the value can't be computed for this scrape.
+type postProcessor struct {
+	help   string
+	derive func(ecoflow *Ecoflow, data EcoflowApiData) (float64, bool)
+}
+
+// postProcessors can be enabled per device with postProcessors in the config,
+// the key is also the metric name
+var postProcessors = map[string]postProcessor{
+	"net_power_watts": {
+		help: "Net battery power, watts input minus watts output",
+		derive: func(ecoflow *Ecoflow, data EcoflowApiData) (float64, bool) {
+			return data.WattsInSum - data.WattsOutSum, true
+		},
+	},
+	"efficiency": {
+		help: "Ratio of watts output to watts input",
+		derive: func(ecoflow *Ecoflow, data EcoflowApiData) (float64, bool) {
+			if data.WattsInSum == 0 {
+				return 0, false
+			}
+			return data.WattsOutSum / data.WattsInSum, true
+		},
+	},
+	// needs the capacity from the API or capacityWh in the config, +Inf without load
+	"runtime_at_current_load_minutes": {
+		help: "Minutes until empty at the current output, soc/100 * capacityWh / watts output * 60",
+		derive: func(ecoflow *Ecoflow, data EcoflowApiData) (float64, bool) {
+			_, capacity := ecoflow.deviceInfo(data)
+			if capacity <= 0 {
+				return 0, false
+			}
+			if data.WattsOutSum <= 0 {
+				return math.Inf(1), true
+			}
+			return data.Soc / 100 * capacity / data.WattsOutSum * 60, true
+		},
+	},
+}
+
+// derivedMetric is a post processor enabled for a device
+type derivedMetric struct {
+	processor postProcessor
+	gauge     prometheus.Gauge
+}
+
+func (metric *derivedMetric) collect(ch chan<- prometheus.Metric, ecoflow *Ecoflow, data EcoflowApiData) {
+	value, ok := metric.processor.derive(ecoflow, data)
+	if !ok {
+		return
+	}
+	metric.gauge.Set(value)
+	ch <- metric.gauge
+}
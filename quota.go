@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// quotaMetricName turns a quota key like inv.acInVol into a metric name
+func quotaMetricName(key string) string {
+	return "quota_" + invalidMetricChars.ReplaceAllString(key, "_")
+}
+
+// quotaValue returns the numeric value of a raw quota field
+func quotaValue(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// quota is the data of a queryDeviceQuota response by quota key. Device models
+// report very different keys, so nothing is dropped while decoding.
+type quota map[string]json.RawMessage
+
+// number returns the numeric value of a key, booleans count as 1/0
+func (q quota) number(key string) (float64, bool) {
+	raw, ok := q[key]
+	if !ok {
+		return 0, false
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return 0, false
+	}
+	return quotaValue(value)
+}
+
+func (q quota) string(key string) string {
+	var value string
+	if raw, ok := q[key]; ok {
+		json.Unmarshal(raw, &value)
+	}
+	return value
+}
+
+// apiData maps the keys the exporter knows about, absent keys are 0
+func (q quota) apiData() EcoflowApiData {
+	var data EcoflowApiData
+	data.Soc, _ = q.number("soc")
+	data.RemainTime, _ = q.number("remainTime")
+	data.WattsOutSum, _ = q.number("wattsOutSum")
+	data.WattsInSum, _ = q.number("wattsInSum")
+	data.Model = q.string("model")
+	data.Firmware = q.firmware()
+	data.CapacityWh, _ = q.number("capacityWh")
+	return data
+}
+
+// firmwareKeys are the firmware version keys, DELTA 2/RIVER 2 and DELTA Pro
+// report the version of the main board as pd.sysVer
+var firmwareKeys = []string{"sysVer", "pd.sysVer"}
+
+// firmware returns the firmware version. Versions are either strings or numbers
+// with one byte per version part, 0x01020304 is 1.2.3.4.
+func (q quota) firmware() string {
+	for _, key := range firmwareKeys {
+		if version := q.string(key); version != "" {
+			return version
+		}
+		if version, ok := q.number(key); ok && version > 0 {
+			v := uint32(version)
+			return fmt.Sprintf("%d.%d.%d.%d", v>>24, v>>16&0xff, v>>8&0xff, v&0xff)
+		}
+	}
+	return ""
+}
+
+// updatingKeys are the firmware update state keys, nonzero while the device
+// installs an update
+var updatingKeys = []string{"otaStatus", "pd.otaStatus", "inv.otaStatus", "bms_bmsStatus.otaStatus"}
+
+// updating tells if the device installs a firmware update
+func (q quota) updating() bool {
+	for _, key := range updatingKeys {
+		if value, ok := q.number(key); ok && value != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hash fingerprints the whole payload
+func (q quota) hash() uint64 {
+	keys := make([]string, 0, len(q))
+	for key := range q {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := fnv.New64a()
+	for _, key := range keys {
+		h.Write([]byte(key))
+		h.Write(q[key])
+	}
+	return h.Sum64()
+}
+
+const (
+	metricTypeGauge   = "gauge"
+	metricTypeCounter = "counter"
+)
+
+// counterKeys are the quota keys known to only grow until the device resets
+// them, the energy totals in Wh and the battery cycles
+var counterKeys = map[string]bool{
+	"pd.chgSunPower":       true,
+	"pd.chgPowerAc":        true,
+	"pd.chgPowerDc":        true,
+	"pd.dsgPowerAc":        true,
+	"pd.dsgPowerDc":        true,
+	"pd.chgPowerAC":        true,
+	"pd.chgPowerDC":        true,
+	"pd.dsgPowerAC":        true,
+	"pd.dsgPowerDC":        true,
+	"bms_bmsStatus.cycles": true,
+	"bmsMaster.cycles":     true,
+}
+
+// quotaMetricType is the type of the metric of a quota key, metricTypes in the
+// device config override the known counter keys
+func quotaMetricType(key string, types map[string]string) string {
+	if metricType, ok := types[key]; ok {
+		return metricType
+	}
+	if counterKeys[key] {
+		return metricTypeCounter
+	}
+	return metricTypeGauge
+}
+
+// quotaMetric exposes one raw quota key listed under metrics in the device
+// config. Counters get the _total suffix and don't decrease on device resets.
+type quotaMetric struct {
+	key       string
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	total     generationCounter
+	value     float64
+	known     bool
+}
+
+// update stores the value of a poll, the caller holds the mutex
+func (metric *quotaMetric) update(data quota) {
+	value, ok := data.number(metric.key)
+	if !ok {
+		return
+	}
+	metric.value, metric.known = value, true
+	if metric.valueType == prometheus.CounterValue {
+		metric.total.update(value)
+		metric.value = metric.total.value()
+	}
+}
+
+// collect sends the metric once the device reported the key, models lacking it
+// just don't have the metric
+func (metric *quotaMetric) collect(ch chan<- prometheus.Metric) {
+	if !metric.known {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(metric.desc, metric.valueType, metric.value)
+}
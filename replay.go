@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+)
+
+// replay is a recorded sequence of API responses. Every device walks through
+// the sequence on its own, one response per poll, and starts over at the end.
+type replay struct {
+	mutex     sync.Mutex
+	responses [][]byte
+	positions map[string]int
+}
+
+// loadReplay reads a file with one JSON API response per line
+func loadReplay(path string) (*replay, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var responses [][]byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) > 0 {
+			responses = append(responses, append([]byte{}, line...))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(responses) == 0 {
+		return nil, errors.New("no responses in " + path)
+	}
+
+	return &replay{responses: responses, positions: make(map[string]int)}, nil
+}
+
+// next returns the next response for the device
+func (r *replay) next(sn string) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	position := r.positions[sn]
+	r.positions[sn] = (position + 1) % len(r.responses)
+	return r.responses[position]
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.jsonl")
+	recorded := `{"code":"0","message":"Success","data":{"soc":40,"wattsInSum":100}}
+
+{"code":"0","message":"Success","data":{"soc":41,"wattsInSum":120}}
+`
+	if err := os.WriteFile(path, []byte(recorded), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := loadReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := newMockApi(t, "key", "secret")
+	options := api.options()
+	options.Replay = replay
+	exporter, err := CreateExporters(api.device("R1"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the responses are served in order and start over at the end
+	for _, soc := range []string{"40", "41", "40"} {
+		expected := `
+# HELP ecoflow_soc State of charge
+# TYPE ecoflow_soc gauge
+ecoflow_soc{description="R1",sn="R1"} ` + soc + "\n"
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "ecoflow_soc"); err != nil {
+			t.Error(err)
+		}
+	}
+	if got := api.requestCount("R1"); got != 0 {
+		t.Errorf("got %d API requests in replay mode, want none", got)
+	}
+}
+
+func TestLoadReplayEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.jsonl")
+	if err := os.WriteFile(path, []byte("\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadReplay(path); err == nil {
+		t.Error("got no error for a file without responses")
+	}
+}
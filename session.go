@@ -0,0 +1,30 @@
+package main
+
+import "time"
+
+// energySession accumulates the energy flowing in one direction between polls.
+// A session starts when the power turns to that direction and ends when it stops
+// or reverses; the energy of the last finished session is kept in last.
+type energySession struct {
+	active bool
+	energy float64
+	last   float64
+	seen   time.Time
+}
+
+// update accounts watts flowing since the previous update, watts <= 0 ends the
+// session
+func (session *energySession) update(watts float64, now time.Time) {
+	if watts > 0 {
+		if session.active {
+			session.energy += watts * now.Sub(session.seen).Hours()
+		} else {
+			session.active = true
+			session.energy = 0
+		}
+	} else if session.active {
+		session.active = false
+		session.last = session.energy
+	}
+	session.seen = now
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnergySession(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var session energySession
+
+	for i, step := range []struct {
+		watts   float64
+		elapsed time.Duration
+		active  bool
+		energy  float64
+		last    float64
+	}{
+		// no session while idle
+		{0, 0, false, 0, 0},
+		// start: the first poll in the direction only marks the time
+		{100, 10 * time.Minute, true, 0, 0},
+		// accumulation: watts times the hours since the previous poll
+		{100, 40 * time.Minute, true, 50, 0},
+		{200, 70 * time.Minute, true, 150, 0},
+		// reset: stopping ends the session and keeps its energy
+		{0, 80 * time.Minute, false, 150, 150},
+		{-50, 90 * time.Minute, false, 150, 150},
+		// a new session starts from zero, the last one is kept until it ends
+		{60, 100 * time.Minute, true, 0, 150},
+		{60, 160 * time.Minute, true, 60, 150},
+		{0, 170 * time.Minute, false, 60, 60},
+	} {
+		session.update(step.watts, start.Add(step.elapsed))
+		if session.active != step.active || session.energy != step.energy || session.last != step.last {
+			t.Errorf("step %d (%v W at %s): got active %v, energy %v, last %v, want %v, %v, %v", i, step.watts, step.elapsed,
+				session.active, session.energy, session.last, step.active, step.energy, step.last)
+		}
+	}
+}
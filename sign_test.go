@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignString(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://api.example.com/iot-open/sign/device/quota?sn=X46&a=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a=1&sn=X46&accessKey=key&nonce=123456&timestamp=1700000000000"
+	if got := signString(req, "key", "123456", "1700000000000"); got != want {
+		t.Errorf("got sign string %q, want %q", got, want)
+	}
+	// HMAC-SHA256 of want keyed by "secret"
+	if got := sign("secret", want); got != "63de0ecf511b74c2e40b6aede142f7bc97ba562cbb0149e3fbac05308d7af526" {
+		t.Errorf("got sign %s", got)
+	}
+}
+
+func TestSignEcoflowRequestHeaders(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://api.example.com/iot-open/sign/certification", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := Ecoflow{AppKey: "key", SecretKey: "secret"}
+	signEcoflowRequest(req, &device, time.UnixMilli(1700000000000))
+
+	if got := req.Header.Get("accessKey"); got != "key" {
+		t.Errorf("got accessKey %q, want key", got)
+	}
+	if got := req.Header.Get("timestamp"); got != "1700000000000" {
+		t.Errorf("got timestamp %q, want 1700000000000", got)
+	}
+	nonce := req.Header.Get("nonce")
+	if len(nonce) != 6 {
+		t.Errorf("got nonce %q, want 6 digits", nonce)
+	}
+	want := sign("secret", "accessKey=key&nonce="+nonce+"&timestamp=1700000000000")
+	if got := req.Header.Get("sign"); got != want {
+		t.Errorf("got sign %q, want %q", got, want)
+	}
+	if got := req.Header.Get("secretKey"); got != "" {
+		t.Errorf("the secretKey is sent: %q", got)
+	}
+}
+
+func TestSignStringLogged(t *testing.T) {
+	logs := captureLogs(t, slog.LevelDebug)
+	req, err := http.NewRequest(http.MethodGet, "https://api.example.com/iot-open/sign/certification", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := Ecoflow{AppKey: "appkey-value", SecretKey: "secret-value"}
+	signEcoflowRequest(req, &device, time.UnixMilli(1700000000000))
+
+	logged := logs.String()
+	want := "accessKey=<redacted>&nonce=" + req.Header.Get("nonce") + "&timestamp=1700000000000"
+	if !strings.Contains(logged, want) {
+		t.Errorf("sign string %q not logged: %s", want, logged)
+	}
+	for _, secret := range []string{"appkey-value", "secret-value", req.Header.Get("sign")} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("%q is logged: %s", secret, logged)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// version and revision are set at build time with
+// -ldflags "-X main.version=... -X main.revision=..."
+var (
+	version  = "dev"
+	revision = "unknown"
+)
+
+var buildInfo *prometheus.GaugeVec
+
+func newBuildInfo() *prometheus.GaugeVec {
+	info := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_build_info",
+		Help:      "Version of the exporter, always 1",
+	}, []string{"version", "revision", "goversion"})
+	info.WithLabelValues(version, revision, runtime.Version()).Set(1)
+	return info
+}
+
+// versionString describes the build for --version
+func versionString() string {
+	return fmt.Sprintf("prometheus-ecoflow-exporter %s (revision %s, %s)", version, revision, runtime.Version())
+}
+
+// defaultUserAgent is the User-Agent of the API requests unless --user-agent is
+// given
+func defaultUserAgent() string {
+	return "prometheus-ecoflow-exporter/" + version
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBuildInfo(t *testing.T) {
+	oldVersion, oldRevision := version, revision
+	version, revision = "1.2.3", "abc123"
+	defer func() { version, revision = oldVersion, oldRevision }()
+
+	expected := `
+# HELP ecoflow_exporter_build_info Version of the exporter, always 1
+# TYPE ecoflow_exporter_build_info gauge
+ecoflow_exporter_build_info{goversion="` + runtime.Version() + `",revision="abc123",version="1.2.3"} 1
+`
+	if err := testutil.CollectAndCompare(newBuildInfo(), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	if got, want := versionString(), "prometheus-ecoflow-exporter 1.2.3 (revision abc123, "+runtime.Version()+")"; got != want {
+		t.Errorf("got version %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+// successWindow keeps the outcomes of the last scrapes to compute a success ratio
+type successWindow struct {
+	results   []bool
+	next      int
+	count     int
+	successes int
+}
+
+func newSuccessWindow(size int) successWindow {
+	return successWindow{results: make([]bool, size)}
+}
+
+func (window *successWindow) add(ok bool) {
+	if window.count == len(window.results) {
+		if window.results[window.next] {
+			window.successes--
+		}
+	} else {
+		window.count++
+	}
+
+	window.results[window.next] = ok
+	if ok {
+		window.successes++
+	}
+	window.next = (window.next + 1) % len(window.results)
+}
+
+func (window *successWindow) ratio() float64 {
+	return float64(window.successes) / float64(window.count)
+}
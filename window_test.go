@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSuccessWindow(t *testing.T) {
+	window := newSuccessWindow(4)
+	if got := window.ratio(); !math.IsNaN(got) {
+		t.Errorf("got ratio %v before any scrape, want NaN", got)
+	}
+
+	for i, step := range []struct {
+		ok   bool
+		want float64
+	}{
+		{true, 1},
+		{false, 0.5},
+		{true, 2.0 / 3},
+		{true, 0.75},
+		// rollover: the oldest result leaves the window
+		{false, 0.5},  // drops true
+		{false, 0.5},  // drops false
+		{false, 0.25}, // drops true
+		{false, 0},    // drops true
+		{true, 0.25},  // drops false
+	} {
+		window.add(step.ok)
+		if got := window.ratio(); got != step.want {
+			t.Errorf("step %d (ok %v): got ratio %v, want %v", i, step.ok, got, step.want)
+		}
+	}
+}